@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Writes every decoded event to a separate JSON lines file. Each record
+// carries the hash of the previous record, so that removing or editing a
+// record breaks the chain.
+type auditLog struct {
+	mu       sync.Mutex
+	file     *rotatingFile
+	fields   []string
+	prevHash string
+}
+
+type auditRecord struct {
+	ReceivedAt time.Time      `json:"received_at"`
+	Event      map[string]any `json:"event"`
+	PrevHash   string         `json:"prev_hash"`
+	Hash       string         `json:"hash"`
+}
+
+// Start an audit log that continues the hash chain from prevHash
+func newAuditLog(file *rotatingFile, fields []string, prevHash string) *auditLog {
+	return &auditLog{
+		file:     file,
+		fields:   fields,
+		prevHash: prevHash,
+	}
+}
+
+// Find the hash of the last record written to an audit log, so that a
+// restarted agent continues the existing chain. The newest rotated file is
+// used if the current one is missing or empty, and an empty hash is returned
+// if there are no records at all.
+func lastAuditHash(path string) (string, error) {
+	for _, candidate := range []string{path, path + ".1"} {
+		line, err := lastLine(candidate)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		if len(line) == 0 {
+			continue
+		}
+
+		var record auditRecord
+		if err := json.Unmarshal(line, &record); err != nil || record.Hash == "" {
+			return "", fmt.Errorf("last record in %s is not a valid audit record", candidate)
+		}
+
+		return record.Hash, nil
+	}
+
+	return "", nil
+}
+
+// Read the last non-empty line of a file, working back from the end so that
+// large files aren't read in full
+func lastLine(path string) ([]byte, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	const chunkSize = 64 * 1024
+
+	var tail []byte
+	for offset := info.Size(); offset > 0; {
+		size := min(chunkSize, offset)
+		offset -= size
+
+		chunk := make([]byte, size)
+		if _, err := file.ReadAt(chunk, offset); err != nil && err != io.EOF {
+			return nil, err
+		}
+
+		tail = append(chunk, tail...)
+
+		trimmed := bytes.TrimRight(tail, "\n")
+		if i := bytes.LastIndexByte(trimmed, '\n'); i >= 0 {
+			return trimmed[i+1:], nil
+		}
+	}
+
+	return bytes.TrimRight(tail, "\n"), nil
+}
+
+// Append an event to the audit log, keeping only the configured top level
+// event fields if any are set
+func (a *auditLog) record(event FaucetEvent, receivedAt time.Time) error {
+	raw, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	fields := map[string]any{}
+	if err := json.Unmarshal(raw, &fields); err != nil {
+		return err
+	}
+
+	if len(a.fields) > 0 {
+		for field := range fields {
+			if !slices.Contains(a.fields, field) {
+				delete(fields, field)
+			}
+		}
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	record := auditRecord{
+		ReceivedAt: receivedAt,
+		Event:      fields,
+		PrevHash:   a.prevHash,
+	}
+
+	unsigned, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	sum := sha256.Sum256(unsigned)
+	record.Hash = hex.EncodeToString(sum[:])
+
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	if _, err := a.file.Write(append(line, '\n')); err != nil {
+		return err
+	}
+
+	a.prevHash = record.Hash
+
+	return nil
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+// Buffers metrics from many events so that they are written to the sinks
+// in fewer, larger requests
+type metricBatcher struct {
+	mu      sync.Mutex
+	sinks   []MetricSink
+	size    int
+	samples int
+	metrics map[string]*dto.MetricFamily
+}
+
+func newMetricBatcher(sinks []MetricSink, size int) *metricBatcher {
+	return &metricBatcher{
+		sinks:   sinks,
+		size:    size,
+		metrics: map[string]*dto.MetricFamily{},
+	}
+}
+
+// Add metrics to the batch, writing it out once it holds enough samples
+func (b *metricBatcher) add(ctx context.Context, metrics map[string]*dto.MetricFamily) {
+	b.mu.Lock()
+
+	for name, family := range metrics {
+		if existing, ok := b.metrics[name]; ok {
+			existing.Metric = append(existing.Metric, family.Metric...)
+		} else {
+			b.metrics[name] = family
+		}
+
+		b.samples += len(family.Metric)
+	}
+
+	full := b.samples >= b.size
+
+	b.mu.Unlock()
+
+	if full {
+		b.flush(ctx)
+	}
+}
+
+// Write out and empty the batch
+func (b *metricBatcher) flush(ctx context.Context) {
+	b.mu.Lock()
+	metrics := b.metrics
+	b.metrics = map[string]*dto.MetricFamily{}
+	b.samples = 0
+	b.mu.Unlock()
+
+	if len(metrics) > 0 {
+		writeMetrics(ctx, b.sinks, metrics)
+	}
+}
+
+// Flush the batch every interval until stop is closed, then drain whatever
+// is left
+func (b *metricBatcher) run(ctx context.Context, stop <-chan struct{}, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			b.flush(ctx)
+
+			return
+		case <-ticker.C:
+			b.flush(ctx)
+		}
+	}
+}
+
+// Send metrics to the sinks, through the batch if batching is enabled
+func emitMetrics(ctx context.Context, sinks []MetricSink, metrics map[string]*dto.MetricFamily) {
+	if len(metrics) == 0 {
+		return
+	}
+
+	if metricBatch != nil {
+		metricBatch.add(ctx, metrics)
+
+		return
+	}
+
+	writeMetrics(ctx, sinks, metrics)
+}
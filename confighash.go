@@ -0,0 +1,63 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+// Labels of the last config hash series written for each datapath
+type configHashTracker struct {
+	mu       sync.Mutex
+	labels   map[int][]*dto.LabelPair
+	lastSeen map[int]time.Time
+}
+
+func newConfigHashTracker() *configHashTracker {
+	return &configHashTracker{
+		labels:   map[int][]*dto.LabelPair{},
+		lastSeen: map[int]time.Time{},
+	}
+}
+
+var configHashes = newConfigHashTracker()
+
+// Record the labels of a datapath's config hash series, returning the labels
+// of the previous series if they were different
+func (t *configHashTracker) swap(dpID int, labels []*dto.LabelPair) []*dto.LabelPair {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	previous, ok := t.labels[dpID]
+	t.labels[dpID] = labels
+	t.lastSeen[dpID] = time.Now()
+
+	if !ok || scrapeSeriesKey("", &dto.Metric{Label: previous}) == scrapeSeriesKey("", &dto.Metric{Label: labels}) {
+		return nil
+	}
+
+	return previous
+}
+
+// Forget the datapaths whose config hashes haven't been written within the
+// ttl, returning the number forgotten. The series written before a
+// forgotten datapath's next config change isn't marked stale.
+func (t *configHashTracker) expire(now time.Time, ttl time.Duration) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	expired := 0
+
+	for dpID, lastSeen := range t.lastSeen {
+		if now.Sub(lastSeen) <= ttl {
+			continue
+		}
+
+		delete(t.labels, dpID)
+		delete(t.lastSeen, dpID)
+		expired++
+	}
+
+	return expired
+}
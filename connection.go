@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// How often the socket file is checked with --watch-socket
+const socketWatchInterval = time.Second
+
+// State of the connection to one event socket
+type eventConnection struct {
+	socket  string
+	retries int
+
+	// Set when the connection was closed because the socket file was
+	// replaced
+	replaced atomic.Bool
+
+	// Guards conn and closed, which are also used by the exit signal handler
+	mu     sync.Mutex
+	conn   net.Conn
+	closed bool
+}
+
+// Set the open connection to the event socket, closing it straight away if
+// the agent is already shutting down
+func (c *eventConnection) setConn(conn net.Conn) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		conn.Close()
+	}
+
+	c.conn = conn
+}
+
+// Close the open connection, if any, and stop new ones being used
+func (c *eventConnection) close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.closed = true
+
+	if c.conn != nil {
+		c.conn.Close()
+	}
+}
+
+// Close the open connection when the socket file at path is replaced by a new
+// one, until the returned function is called
+func (c *eventConnection) watchSocketFile(ctx context.Context, path string) func() {
+	ctx, cancel := context.WithCancel(ctx)
+
+	connected, err := os.Stat(path)
+	if err != nil {
+		return cancel
+	}
+
+	go func() {
+		ticker := time.NewTicker(socketWatchInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				// A missing file may be faucet restarting, wait for the
+				// new socket
+				current, err := os.Stat(path)
+				if err != nil || os.SameFile(connected, current) {
+					continue
+				}
+
+				c.replaced.Store(true)
+
+				c.mu.Lock()
+				if c.conn != nil {
+					c.conn.Close()
+				}
+				c.mu.Unlock()
+
+				return
+			}
+		}
+	}()
+
+	return cancel
+}
+
+// Every event socket connection, so that they can all be closed on shutdown
+type connectionRegistry struct {
+	mu    sync.Mutex
+	conns []*eventConnection
+}
+
+var eventConnections = &connectionRegistry{}
+
+func (r *connectionRegistry) add(socket string) *eventConnection {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	c := &eventConnection{socket: socket}
+	r.conns = append(r.conns, c)
+
+	return c
+}
+
+// Close every connection, unblocking their reads
+func (r *connectionRegistry) closeAll() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, c := range r.conns {
+		c.close()
+	}
+}
+
+// Reads from a connection, failing with a timeout error if no data arrives
+// within the timeout of starting each read
+type deadlineReader struct {
+	conn    net.Conn
+	timeout time.Duration
+}
+
+func (r deadlineReader) Read(p []byte) (int, error) {
+	if err := r.conn.SetReadDeadline(time.Now().Add(r.timeout)); err != nil {
+		return 0, err
+	}
+
+	return r.conn.Read(p)
+}
+
+// Counts the bytes read from a reader
+type countingReader struct {
+	reader io.Reader
+	bytes  prometheus.Counter
+}
+
+func (r countingReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.bytes.Add(float64(n))
+
+	return n, err
+}
+
+// Build the TLS configuration for tcp:// event sockets, or nil to connect
+// without TLS when none of the files are set. Without a CA file the system
+// roots verify the controller.
+func eventSocketTLSConfig(caFile string, certFile string, keyFile string) (*tls.Config, error) {
+	if caFile == "" && certFile == "" {
+		return nil, nil
+	}
+
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", caFile)
+		}
+
+		config.RootCAs = pool
+	}
+
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	return config, nil
+}
+
+// Wrap a TCP connection to an event socket in TLS, verifying the controller
+// against the host in address. The handshake is done here, so that a failure
+// is handled like a failure to connect.
+func tlsHandshake(ctx context.Context, conn net.Conn, address string) (*tls.Conn, error) {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+
+	config := eventTLSConfig.Clone()
+	config.ServerName = host
+
+	tlsConn := tls.Client(conn, config)
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		return nil, err
+	}
+
+	return tlsConn, nil
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+// Running totals for counters derived from events, which are pushed to
+// remote write with their cumulative value
+type counterStore struct {
+	mu       sync.Mutex
+	values   map[string]float64
+	lastSeen map[string]time.Time
+}
+
+func newCounterStore() *counterStore {
+	return &counterStore{
+		values:   map[string]float64{},
+		lastSeen: map[string]time.Time{},
+	}
+}
+
+var eventCounters = newCounterStore()
+
+// Increment the counter with the given name and labels, returning its new
+// value. Labels removed by --drop-labels and --keep-labels aren't part of the
+// counter, so counters that only differed by them are added together.
+func (c *counterStore) inc(name string, labels []*dto.LabelPair) float64 {
+	return c.add(name, labels, 1)
+}
+
+// Add delta to the counter with the given name and labels, returning its new
+// value. Adding 0 returns the current value.
+func (c *counterStore) add(name string, labels []*dto.LabelPair, delta float64) float64 {
+	var key strings.Builder
+
+	key.WriteString(name)
+	for _, label := range counterLabels(labels) {
+		// The event ID exemplar differs for every event, while the
+		// counter counts all of them
+		if strings.HasPrefix(label.GetName(), exemplarLabelPrefix) {
+			continue
+		}
+
+		key.WriteByte(0xff)
+		key.WriteString(label.GetName())
+		key.WriteByte(0xfe)
+		key.WriteString(label.GetValue())
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.values[key.String()] += delta
+	c.lastSeen[key.String()] = time.Now()
+
+	return c.values[key.String()]
+}
+
+// Forget the counters that haven't been updated within the ttl, returning
+// the number forgotten. A forgotten counter starts again from 0, which
+// receivers treat as a counter reset.
+func (c *counterStore) expire(now time.Time, ttl time.Duration) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	expired := 0
+
+	for key, lastSeen := range c.lastSeen {
+		if now.Sub(lastSeen) <= ttl {
+			continue
+		}
+
+		delete(c.values, key)
+		delete(c.lastSeen, key)
+		expired++
+	}
+
+	return expired
+}
+
+// Labels of a counter series, which are filtered like any other series but
+// leave out the event_id label added by --event-id label, since a counter
+// counts many events
+func counterLabels(labels []*dto.LabelPair) []*dto.LabelPair {
+	labels = filterLabels(labels)
+	if *eventIDMode != "label" {
+		return labels
+	}
+
+	return slices.DeleteFunc(slices.Clone(labels), func(label *dto.LabelPair) bool {
+		return label.GetName() == "event_id"
+	})
+}
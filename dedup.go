@@ -0,0 +1,119 @@
+package main
+
+import (
+	"container/list"
+	"strings"
+	"sync"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+// A learn series that has been written, along with when it was written
+type dedupEntry struct {
+	key     string
+	written time.Time
+}
+
+// Suppresses learn series that are identical to one written within the
+// window, such as when faucet reports the same host several times in quick
+// succession. The least recently seen series are forgotten once there are
+// more than maxEntries.
+type dedupTracker struct {
+	mu         sync.Mutex
+	window     time.Duration
+	maxEntries int
+	order      *list.List
+	entries    map[string]*list.Element
+}
+
+func newDedupTracker(window time.Duration, maxEntries int) *dedupTracker {
+	return &dedupTracker{
+		window:     window,
+		maxEntries: maxEntries,
+		order:      list.New(),
+		entries:    map[string]*list.Element{},
+	}
+}
+
+// Remove the learn series from a set of metrics that were already written
+// within the window, returning the number removed. Families left without any
+// series are removed too.
+func (t *dedupTracker) filter(metrics map[string]*dto.MetricFamily, now time.Time) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	suppressed := 0
+
+	for name, family := range metrics {
+		if !isLearnMetric(name) {
+			continue
+		}
+
+		kept := family.Metric[:0]
+		for _, metric := range family.GetMetric() {
+			if t.seen(dedupKey(name, metric), now) {
+				suppressed++
+
+				continue
+			}
+
+			kept = append(kept, metric)
+		}
+
+		family.Metric = kept
+		if len(kept) == 0 {
+			delete(metrics, name)
+		}
+	}
+
+	return suppressed
+}
+
+// Report whether a series was written within the window, recording it as
+// written now if it wasn't. A suppressed series keeps its original write
+// time, so that it is written again once per window while it keeps repeating.
+func (t *dedupTracker) seen(key string, now time.Time) bool {
+	if element, ok := t.entries[key]; ok {
+		t.order.MoveToFront(element)
+
+		entry := element.Value.(*dedupEntry)
+		if now.Sub(entry.written) < t.window {
+			return true
+		}
+
+		entry.written = now
+
+		return false
+	}
+
+	t.entries[key] = t.order.PushFront(&dedupEntry{key: key, written: now})
+
+	for t.order.Len() > t.maxEntries {
+		oldest := t.order.Back()
+		t.order.Remove(oldest)
+		delete(t.entries, oldest.Value.(*dedupEntry).key)
+	}
+
+	return false
+}
+
+// Key for a series by name and labels, leaving out exemplar labels since
+// they carry the event ID, which differs for every event
+func dedupKey(name string, metric *dto.Metric) string {
+	var key strings.Builder
+
+	key.WriteString(name)
+	for _, label := range metric.GetLabel() {
+		if strings.HasPrefix(label.GetName(), exemplarLabelPrefix) {
+			continue
+		}
+
+		key.WriteByte(0xff)
+		key.WriteString(label.GetName())
+		key.WriteByte(0xfe)
+		key.WriteString(label.GetValue())
+	}
+
+	return key.String()
+}
@@ -0,0 +1,44 @@
+package main
+
+import "fmt"
+
+// Well known EtherTypes
+const (
+	etherTypeIPv4          = 0x0800
+	etherTypeARP           = 0x0806
+	etherTypeRARP          = 0x8035
+	etherTypeVLAN          = 0x8100
+	etherTypeIPv6          = 0x86dd
+	etherTypeSlowProtocols = 0x8809
+	etherTypeMPLS          = 0x8847
+	etherTypeMPLSMulticast = 0x8848
+	etherTypeEAPOL         = 0x888e
+	etherTypeQinQ          = 0x88a8
+	etherTypeLLDP          = 0x88cc
+	etherTypePTP           = 0x88f7
+)
+
+// Names of well known EtherTypes
+var etherTypeNames = map[int]string{
+	etherTypeIPv4:          "ipv4",
+	etherTypeARP:           "arp",
+	etherTypeRARP:          "rarp",
+	etherTypeVLAN:          "vlan",
+	etherTypeIPv6:          "ipv6",
+	etherTypeSlowProtocols: "slow_protocols",
+	etherTypeMPLS:          "mpls",
+	etherTypeMPLSMulticast: "mpls_multicast",
+	etherTypeEAPOL:         "eapol",
+	etherTypeQinQ:          "qinq",
+	etherTypeLLDP:          "lldp",
+	etherTypePTP:           "ptp",
+}
+
+// Name of an EtherType, or its hex value when it isn't well known
+func etherTypeName(ethType int) string {
+	if name, ok := etherTypeNames[ethType]; ok {
+		return name
+	}
+
+	return fmt.Sprintf("0x%04x", ethType)
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+)
+
+// Appends each event as a JSON line to a local file, for keeping a copy of
+// every event
+type fileSink struct {
+	name string
+	file *rotatingFile
+}
+
+func newFileSink(file *rotatingFile) *fileSink {
+	return &fileSink{
+		name: "file:" + file.path,
+		file: file,
+	}
+}
+
+func (s *fileSink) Name() string {
+	return s.name
+}
+
+func (s *fileSink) WriteEvent(ctx context.Context, event FaucetEvent) error {
+	line, err := json.Marshal(event)
+	if err != nil {
+		marshalErrors.WithLabelValues(s.name).Inc()
+
+		slog.Error("Unable to marshal event for file", "sink", s.name, "error", err.Error())
+
+		return err
+	}
+
+	// A single write under the file's lock, so lines from concurrent
+	// workers don't interleave
+	if _, err := s.file.Write(append(line, '\n')); err != nil {
+		slog.Error("Unable to write event to file", "sink", s.name, "error", err.Error())
+
+		return err
+	}
+
+	return nil
+}
+
+// Reopen the files of the file sinks, after they have been moved by an
+// external log rotation tool
+func reopenFileSinks() {
+	for _, sink := range eventSinks {
+		if s, ok := sink.(*fileSink); ok {
+			if err := s.file.Reopen(); err != nil {
+				slog.Error("Failed to reopen event file", "sink", s.name, "error", err.Error())
+			}
+		}
+	}
+}
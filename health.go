@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// Number of event sockets currently connected
+	connectedSockets atomic.Int32
+	// Unix nanoseconds of the last successful and failed remote writes
+	lastRemoteWriteSuccess atomic.Int64
+	lastRemoteWriteFailure atomic.Int64
+)
+
+func registerHealthHandlers(mux *http.ServeMux) {
+	mux.HandleFunc("/healthz", handleHealthz)
+	mux.HandleFunc("/readyz", handleReadyz)
+}
+
+// The process is alive if it can answer at all
+func handleHealthz(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprintln(w, "ok")
+}
+
+// Ready when an event socket is connected and remote writes are working,
+// meaning no remote write has failed since the last success, or the last
+// success was recent enough to ride out a brief outage
+func handleReadyz(w http.ResponseWriter, r *http.Request) {
+	if connectedSockets.Load() == 0 {
+		http.Error(w, "event socket not connected", http.StatusServiceUnavailable)
+
+		return
+	}
+
+	success := lastRemoteWriteSuccess.Load()
+	failure := lastRemoteWriteFailure.Load()
+
+	if failure > success && time.Since(time.Unix(0, success)) > *readyThreshold {
+		http.Error(w, "remote write failing", http.StatusServiceUnavailable)
+
+		return
+	}
+
+	fmt.Fprintln(w, "ok")
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/version"
+	"google.golang.org/protobuf/proto"
+)
+
+// Push faucet_agent_up every interval, so an idle agent can be told apart
+// from one that has stopped
+func runHeartbeat(ctx context.Context, sinks []MetricSink, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		writeHeartbeat(ctx, sinks)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func writeHeartbeat(ctx context.Context, sinks []MetricSink) {
+	labels := []*dto.LabelPair{
+		{
+			Name:  proto.String("instance"),
+			Value: proto.String(hostname),
+		},
+		{
+			Name:  proto.String("version"),
+			Value: proto.String(version.Version),
+		},
+	}
+
+	writeMetrics(ctx, sinks, map[string]*dto.MetricFamily{
+		"faucet_agent_up": gaugeFamily("faucet_agent_up", labels, 1, time.Now().UnixMilli()),
+	})
+}
+
+// Write faucet_agent_build_info to every sink once, returning whether all of
+// the writes succeeded
+func writeBuildInfo(ctx context.Context, sinks []MetricSink) bool {
+	labels := []*dto.LabelPair{
+		{
+			Name:  proto.String("instance"),
+			Value: proto.String(hostname),
+		},
+		{
+			Name:  proto.String("version"),
+			Value: proto.String(version.Version),
+		},
+		{
+			Name:  proto.String("revision"),
+			Value: proto.String(version.Revision),
+		},
+		{
+			Name:  proto.String("goversion"),
+			Value: proto.String(version.GoVersion),
+		},
+	}
+
+	metrics := map[string]*dto.MetricFamily{
+		"faucet_agent_build_info": gaugeFamily("faucet_agent_build_info", labels, 1, time.Now().UnixMilli()),
+	}
+
+	ok := true
+
+	for _, sink := range sinks {
+		if err := sink.Write(ctx, metrics); err != nil {
+			ok = false
+
+			continue
+		}
+
+		slog.Info("Wrote build info", "sink", sink.Name())
+	}
+
+	return ok
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// Tracks the distinct L3 source IPs seen on each datapath, forgetting
+// hosts that have not been seen within the ttl. With a max above 0, no more
+// than max hosts are tracked per datapath.
+type hostTracker struct {
+	mu        sync.Mutex
+	ttl       time.Duration
+	max       int
+	seen      map[int]map[string]time.Time
+	lastPrune map[int]time.Time
+}
+
+func newHostTracker(ttl time.Duration, max int) *hostTracker {
+	return &hostTracker{
+		ttl:       ttl,
+		max:       max,
+		seen:      map[int]map[string]time.Time{},
+		lastPrune: map[int]time.Time{},
+	}
+}
+
+// Record a host on a datapath and return the number of distinct hosts
+// currently known on that datapath. A new host on a datapath that already
+// has the maximum number of hosts is refused, returning false.
+func (t *hostTracker) observe(dpID int, ip string, now time.Time) (int, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	hosts, ok := t.seen[dpID]
+	if !ok {
+		hosts = map[string]time.Time{}
+		t.seen[dpID] = hosts
+	}
+
+	// Expired hosts are only swept once per minute to keep this cheap, or
+	// when a new host needs room
+	if now.Sub(t.lastPrune[dpID]) >= time.Minute || t.full(hosts, ip) {
+		for host, lastSeen := range hosts {
+			if now.Sub(lastSeen) > t.ttl {
+				delete(hosts, host)
+			}
+		}
+
+		t.lastPrune[dpID] = now
+	}
+
+	if t.full(hosts, ip) {
+		return len(hosts), false
+	}
+
+	hosts[ip] = now
+
+	return len(hosts), true
+}
+
+// Whether there is no room for ip in a datapath's hosts
+func (t *hostTracker) full(hosts map[string]time.Time, ip string) bool {
+	if _, ok := hosts[ip]; ok || t.max == 0 {
+		return false
+	}
+
+	return len(hosts) >= t.max
+}
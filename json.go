@@ -51,3 +51,24 @@ type L3Learn struct {
 	PortNo  int    `json:"port_no"`
 	Vid     int    `json:"vid"`
 }
+
+// Names of the event types that are handled
+var eventTypeNames = []string{"L3_LEARN", "L2_LEARN", "PORT_CHANGE", "DP_CHANGE", "CONFIG_CHANGE"}
+
+// Name of the faucet event type carried by the event
+func (e FaucetEvent) Type() string {
+	switch {
+	case e.L3Learn != nil:
+		return "L3_LEARN"
+	case e.L2Learn != nil:
+		return "L2_LEARN"
+	case e.PortChange != nil:
+		return "PORT_CHANGE"
+	case e.DpChange != nil:
+		return "DP_CHANGE"
+	case e.ConfigChange != nil:
+		return "CONFIG_CHANGE"
+	default:
+		return "UNKNOWN"
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// Publishes each event as JSON to a kafka topic, keyed by datapath name so
+// that the events of a datapath stay in order
+type kafkaSink struct {
+	name   string
+	writer *kafka.Writer
+}
+
+func newKafkaSink(brokers []string, topic string, timeout time.Duration) *kafkaSink {
+	return &kafkaSink{
+		name: "kafka:" + topic,
+		writer: &kafka.Writer{
+			Addr:         kafka.TCP(brokers...),
+			Topic:        topic,
+			Balancer:     &kafka.Hash{},
+			RequiredAcks: kafka.RequireAll,
+			// Retries are done here with the usual backoff instead
+			MaxAttempts: 1,
+			// Events are written one at a time, so there's nothing to
+			// wait for
+			BatchTimeout: time.Millisecond,
+			WriteTimeout: timeout,
+		},
+	}
+}
+
+func (s *kafkaSink) Name() string {
+	return s.name
+}
+
+// Close the connections to the brokers, once every event has been written
+func (s *kafkaSink) Close() error {
+	return s.writer.Close()
+}
+
+func (s *kafkaSink) WriteEvent(ctx context.Context, event FaucetEvent) error {
+	value, err := json.Marshal(event)
+	if err != nil {
+		marshalErrors.WithLabelValues(s.name).Inc()
+
+		slog.Error("Unable to marshal event for kafka", "sink", s.name, "error", err.Error())
+
+		return err
+	}
+
+	if *dryRun {
+		slog.Info("Kafka message", "sink", s.name, "key", event.DpName, "value", string(value))
+
+		return nil
+	}
+
+	message := kafka.Message{
+		Key:   []byte(event.DpName),
+		Value: value,
+	}
+
+	for attempt := 0; ; attempt++ {
+		err = s.writer.WriteMessages(ctx, message)
+		if err == nil || attempt >= *kafkaRetries || ctx.Err() != nil {
+			break
+		}
+
+		delay := backoff(*initialBackoff, *maxBackoff, attempt)
+
+		slog.Warn(
+			"Retrying kafka message",
+			"sink",
+			s.name,
+			"attempt",
+			attempt+1,
+			"backoff",
+			delay,
+			"error",
+			err.Error(),
+		)
+
+		backoffDelay(ctx, delay)
+	}
+
+	if err != nil {
+		slog.Error(
+			"Unable to publish event to kafka",
+			"sink",
+			s.name,
+			"type",
+			event.Type(),
+			"event_id",
+			event.EventID,
+			"error",
+			err.Error(),
+		)
+
+		return err
+	}
+
+	return nil
+}
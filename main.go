@@ -2,52 +2,182 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"io"
 	"log/slog"
-	"math"
+	"maps"
 	"net"
+	"net/http"
 	"net/url"
 	"os"
 	"os/signal"
+	"regexp"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
-	"github.com/golang/snappy"
 	"github.com/peterbourgon/ff/v4"
 	"github.com/peterbourgon/ff/v4/ffhelp"
-	dto "github.com/prometheus/client_model/go"
-	prom_config "github.com/prometheus/common/config"
-	"github.com/prometheus/common/model"
+	"github.com/peterbourgon/ff/v4/ffyaml"
 	"github.com/prometheus/common/version"
-	"github.com/prometheus/prometheus/storage/remote"
-	"github.com/prometheus/prometheus/util/fmtutil"
 	"golang.org/x/exp/rand"
-	"google.golang.org/protobuf/proto"
 )
 
 const (
-	binName        = "faucet_agent"
-	timeout        = 15 * time.Second
-	initialBackoff = 5 * time.Second
-	maxBackoff     = 5 * time.Minute
+	binName = "faucet_agent"
+	timeout = 15 * time.Second
+
+	defaultPromUrl      = "http://localhost:9090/api/v1/write"
+	defaultOTLPEndpoint = "http://localhost:4318/v1/metrics"
+	defaultEventSocket  = "/run/faucet/event.sock"
+
+	// Environment variable with the separator for splitting environment
+	// variable values
+	envVarSplit = "FAUCET_AGENT_ENV_SPLIT"
+
+	// Range of faucet event schema versions the agent understands
+	minEventVersion = 1
+	maxEventVersion = 1
+
+	// Event timestamps before 2000-01-01 can't be real
+	minEventTime = 946684800
+
+	// Timestamps above this are taken to be in milliseconds by
+	// --timestamp-unit auto, in seconds it is in the year 5138
+	maxEventTimeSeconds = 1e11
 )
 
 var (
-	logLevel    *string
-	slogLevel   *slog.LevelVar = new(slog.LevelVar)
-	promUrl     *string
-	eventSocket *string
+	displayVersion  *bool
+	configFile      *string
+	logLevel        *string
+	logFormat       *string
+	logSource       *bool
+	debugSampleRate *int
+	metricsPrefix   *string
+	watchSocket     *bool
+	slogLevel       *slog.LevelVar = new(slog.LevelVar)
+	mode            *string
+	sinkTypes       *[]string
+	kafkaBrokers    *[]string
+	kafkaTopic      *string
+	kafkaRetries    *int
+	kafkaTimeout    *time.Duration
+	filePath        *string
+	fileMaxSize     *int64
+	fileMaxAge      *time.Duration
+	fileMaxBackups  *int
+	otlpEndpoint    *string
+	pushgatewayURL  *string
+	pushgatewayJob  *string
+	nameValidation  *string
+	jobName         *string
+	instanceName    *string
+	metricTTL       *time.Duration
+	dedupWindow     *time.Duration
+	dedupMaxEntries *int
+	resolveEthTypes *bool
+	dryRun          *bool
+	scrapeTTL       *time.Duration
+	stateTTL        *time.Duration
+	promUrls        *[]string
+	promFlags       *remoteWriteFlags
+	promTimeout     *time.Duration
+	promCompression *string
+	promVersion     *string
+	promRetries     *int
+	maxRequestRate  *float64
+	maxBurst        *int
+	maxSampleAge    *time.Duration
+	maxReqSamples   *int
+	maxReconnects   *int
+	minHealthy      *time.Duration
+	backoffJitter   *float64
+	noBackoffJitter *bool
+	initialBackoff  *time.Duration
+	maxBackoff      *time.Duration
+	eventSockets    *[]string
+	eventFile       *string
+	eventTypes      *[]string
+	sampleRates     *[]string
+	dropLabels      *[]string
+	keepLabels      *[]string
+	eventCompress   *string
+	eventTLSCA      *string
+	eventTLSCert    *string
+	eventTLSKey     *string
+	timestampUnit   *string
+	readTimeout     *time.Duration
+	eventBufferSize *int
+	maxEventSize    *int
+	workerCount     *int
+	eventQueueSize  *int
+	sinkQueueSize   *int
+	batchSize       *int
+	batchInterval   *time.Duration
+	queueDir        *string
+	queueMaxBytes   *int64
+	versionLabel    *bool
+	eventIDMode     *string
+	dpNameFallback  *string
+	dpNameStrip     *string
+	dpNamePrefix    *string
+	pauseUntil      *string
+	l3HostTTL       *time.Duration
+	maxL3Hosts      *int
+	portNamesFile   *string
+	relabelFile     *string
+	vlanMapFile     *string
+	auditLogFile    *string
+	auditLogMaxSize *int64
+	auditLogBackups *int
+	auditLogFields  *[]string
+
+	heartbeatInterval *time.Duration
+	oneshot           *bool
+	shutdownTimeout   *time.Duration
+
+	metricsAddress  *string
+	metricsFailFast *bool
+	healthAddress   *string
+	readyThreshold  *time.Duration
+	metricsTLSCert  *string
+	metricsTLSKey   *string
+	metricsClientCA *string
+
+	flagSet *ff.FlagSet
 
 	hostname string
 
-	conn net.Conn
+	dpNameStripRegexp *regexp.Regexp
+	allowedEventTypes map[string]bool
+	eventSampleRates  map[string]float64
+	droppedLabels     map[string]bool
+	keptLabels        map[string]bool
 
-	retries int
+	l3Hosts       *hostTracker
+	scrapeMetrics *scrapeSink
+	metricBatch   *metricBatcher
+	staleness     *stalenessTracker
+	dedup         *dedupTracker
+	eventSinks    []EventSink
+	audit         *auditLog
+
+	// TLS configuration for tcp:// event sockets, nil for plain TCP
+	eventTLSConfig *tls.Config
+
+	// Effective configuration logged on every event socket connection
+	configSummary []slog.Attr
 )
 
 // Print program usage
@@ -64,7 +194,12 @@ func printVersion() {
 
 func init() {
 	fs := ff.NewFlagSet(binName)
-	displayVersion := fs.BoolLong("version", "Print version")
+	displayVersion = fs.BoolLong("version", "Print version")
+	configFile = fs.StringLong(
+		"config",
+		"",
+		"YAML or JSON config file with flag names as keys, overridden by environment variables and flags",
+	)
 	logLevel = fs.StringEnumLong(
 		"log-level",
 		"Log level: debug, info, warn, error",
@@ -73,24 +208,541 @@ func init() {
 		"error",
 		"warn",
 	)
-	promUrl = fs.StringLong(
+	logFormat = fs.StringEnumLong(
+		"log-format",
+		"Log format: text, json",
+		"text",
+		"json",
+	)
+	logSource = fs.BoolLong(
+		"log-source",
+		"Include the source file and line of the log call in logs",
+	)
+	debugSampleRate = fs.IntLong(
+		"debug-log-sample-rate",
+		1,
+		"Only log 1 in this many received events at debug level",
+	)
+	mode = fs.StringEnumLong(
+		"mode",
+		"How to expose metrics: remote-write to push them, scrape to serve them on the metrics address",
+		"remote-write",
+		"scrape",
+	)
+
+	sinkTypes = fs.StringListLong(
+		"sink",
+		"Where to push metrics in remote-write mode: remote-write for prometheus remote write, otlp for an OTLP/HTTP collector, pushgateway for a prometheus pushgateway, or kafka or file for the events themselves, may be repeated to use several at once (default: remote-write)",
+	)
+
+	kafkaBrokers = fs.StringListLong(
+		"kafka-brokers",
+		"Comma separated kafka brokers to publish events to with --sink kafka, may be repeated",
+	)
+
+	kafkaTopic = fs.StringLong(
+		"kafka-topic",
+		"faucet_events",
+		"Kafka topic to publish events to with --sink kafka",
+	)
+
+	kafkaRetries = fs.IntLong(
+		"kafka-retries",
+		3,
+		"Number of times to retry publishing an event to kafka",
+	)
+
+	kafkaTimeout = fs.DurationLong(
+		"kafka-timeout",
+		timeout,
+		"Timeout for publishing an event to kafka",
+	)
+
+	filePath = fs.StringLong(
+		"file-path",
+		"",
+		"Path to write events to as JSON lines with --sink file",
+	)
+
+	fileMaxSize = fs.Int64Long(
+		"file-max-size",
+		100*1024*1024,
+		"Size in bytes at which the --sink file file is rotated, 0 for no limit",
+	)
+
+	fileMaxAge = fs.DurationLong(
+		"file-max-age",
+		0,
+		"Time after which the --sink file file is rotated, 0 for no limit",
+	)
+
+	fileMaxBackups = fs.IntLong(
+		"file-max-backups",
+		5,
+		"Number of rotated --sink file files to keep",
+	)
+
+	otlpEndpoint = fs.StringLong(
+		"otlp-endpoint",
+		defaultOTLPEndpoint,
+		"OTLP/HTTP metrics endpoint to push to with --sink otlp",
+	)
+
+	pushgatewayURL = fs.StringLong(
+		"pushgateway-url",
+		"http://localhost:9091",
+		"Pushgateway to push to with --sink pushgateway",
+	)
+
+	pushgatewayJob = fs.StringLong(
+		"pushgateway-job",
+		binName,
+		"Job to push metrics under with --sink pushgateway",
+	)
+
+	metricTTL = fs.DurationLong(
+		"metric-ttl",
+		0,
+		"Time after which learn metrics that haven't been updated are marked stale with remote write, 0 to never mark them stale",
+	)
+
+	dedupWindow = fs.DurationLong(
+		"dedup-window",
+		0,
+		"Skip learn series identical to one written within this long, 0 to write every learn event",
+	)
+
+	dedupMaxEntries = fs.IntLong(
+		"dedup-max-entries",
+		100000,
+		"Maximum number of learn series remembered for --dedup-window, forgetting the least recently seen",
+	)
+
+	scrapeTTL = fs.DurationLong(
+		"scrape-ttl",
+		time.Hour,
+		"Time after which learn metrics that haven't been updated are removed in scrape mode, 0 to keep them forever",
+	)
+
+	stateTTL = fs.DurationLong(
+		"state-ttl",
+		24*time.Hour,
+		"Time after which counters, port statuses and config hashes that haven't been updated are forgotten, 0 to keep them forever",
+	)
+
+	dryRun = fs.BoolLong(
+		"dry-run",
+		"Log the remote write requests that would be sent instead of sending them",
+	)
+
+	promUrls = fs.StringListLong(
 		"prometheus-remote-write-uri",
-		"http://localhost:9090/api/v1/write",
-		"Prometheus remote write URI",
+		"Prometheus remote write URI, may be repeated (default: "+defaultPromUrl+")",
+	)
+
+	promFlags = addRemoteWriteFlags(fs)
+
+	promTimeout = fs.DurationLong(
+		"remote-write-timeout",
+		timeout,
+		"Timeout for prometheus remote write requests",
+	)
+
+	promCompression = fs.StringEnumLong(
+		"remote-write-compression",
+		"Compression for remote write request bodies: snappy, none",
+		"snappy",
+		"none",
+	)
+
+	promVersion = fs.StringEnumLong(
+		"remote-write-version",
+		"Remote write protocol version: 1.0, 2.0, or auto to detect what the receiver supports",
+		remoteWriteV1,
+		remoteWriteV2,
+		remoteWriteAuto,
+	)
+
+	promRetries = fs.IntLong(
+		"remote-write-retries",
+		3,
+		"Number of times to retry remote write requests that fail with a retryable error",
+	)
+
+	maxRequestRate = fs.Float64Long(
+		"max-requests-per-second",
+		0,
+		"Maximum remote write requests per second to each receiver, 0 for no limit",
+	)
+
+	maxBurst = fs.IntLong(
+		"max-burst",
+		10,
+		"Number of remote write requests that may be sent at once above --max-requests-per-second",
+	)
+
+	maxReqSamples = fs.IntLong(
+		"max-request-samples",
+		0,
+		"Maximum samples in a single remote write request, larger batches are split into several requests, 0 for no limit",
+	)
+
+	maxSampleAge = fs.DurationLong(
+		"max-sample-age",
+		0,
+		"Drop samples older than this instead of writing them with remote write, 0 to write samples of any age",
+	)
+
+	maxReconnects = fs.IntLong(
+		"max-reconnect-attempts",
+		0,
+		"Exit after this many consecutive failed attempts to connect to an event socket, 0 to keep retrying forever",
+	)
+
+	minHealthy = fs.DurationLong(
+		"min-healthy-duration",
+		10*time.Second,
+		"Time a connection to an event socket must stay up for before the reconnect backoff is reset",
+	)
+
+	initialBackoff = fs.DurationLong(
+		"initial-backoff",
+		5*time.Second,
+		"Initial delay before reconnecting or retrying queued remote writes",
+	)
+
+	maxBackoff = fs.DurationLong(
+		"max-backoff",
+		5*time.Minute,
+		"Maximum delay before reconnecting or retrying queued remote writes",
+	)
+
+	backoffJitter = fs.Float64Long(
+		"backoff-jitter",
+		0.5,
+		"Maximum random jitter added to each backoff, as a fraction of the exponential delay",
+	)
+
+	noBackoffJitter = fs.BoolLong(
+		"no-backoff-jitter",
+		"Don't add random jitter to backoffs, for reproducible retry timing in tests",
 	)
 
-	eventSocket = fs.StringLong(
+	eventSockets = fs.StringListLong(
 		"event-socket",
-		"/run/faucet/event.sock",
-		"Path to faucet event socket",
+		"Faucet event socket, as a path, unix:///path or tcp://host:port, may be repeated (default: "+defaultEventSocket+")",
 	)
 
-	err := ff.Parse(fs, os.Args[1:],
-		ff.WithEnvVarPrefix(strings.ToUpper(binName)),
-		ff.WithEnvVarSplit(" "),
+	watchSocket = fs.BoolLong(
+		"watch-socket",
+		"Reconnect as soon as a unix event socket file is replaced, such as when faucet restarts",
 	)
-	if err != nil {
-		printUsage(fs)
+
+	eventFile = fs.StringLong(
+		"event-file",
+		"",
+		"Read newline delimited events from a file, or - for stdin, instead of the event socket",
+	)
+
+	eventTypes = fs.StringListLong(
+		"event-types",
+		"Comma separated event types to handle, may be repeated (default: all): L3_LEARN, L2_LEARN, PORT_CHANGE, DP_CHANGE, CONFIG_CHANGE",
+	)
+
+	sampleRates = fs.StringListLong(
+		"sample-rate",
+		"Fraction of events of a type to build metrics from as TYPE=fraction, e.g. L2_LEARN=0.1, may be repeated for L2_LEARN and L3_LEARN (default: all events)",
+	)
+
+	dropLabels = fs.StringListLong(
+		"drop-labels",
+		"Comma separated labels to remove from the metrics built from events, may be repeated",
+	)
+
+	keepLabels = fs.StringListLong(
+		"keep-labels",
+		"Comma separated labels to keep on the metrics built from events, removing all others, may be repeated (default: all)",
+	)
+
+	readTimeout = fs.DurationLong(
+		"event-read-timeout",
+		0,
+		"Reconnect to an event socket if nothing has been read from it for this long, 0 to wait forever",
+	)
+
+	timestampUnit = fs.StringEnumLong(
+		"timestamp-unit",
+		"Unit of event timestamps: auto to tell seconds and milliseconds apart by their size, seconds, milliseconds",
+		"auto",
+		"seconds",
+		"milliseconds",
+	)
+
+	eventCompress = fs.StringEnumLong(
+		"event-compression",
+		"Compression of the event socket stream: none, gzip",
+		"none",
+		"gzip",
+	)
+
+	eventTLSCA = fs.StringLong(
+		"event-tls-ca-file",
+		"",
+		"CA certificate file to verify tcp:// event sockets with, connecting over TLS",
+	)
+
+	eventTLSCert = fs.StringLong(
+		"event-tls-cert-file",
+		"",
+		"Client certificate file for tcp:// event sockets, connecting over TLS",
+	)
+
+	eventTLSKey = fs.StringLong(
+		"event-tls-key-file",
+		"",
+		"Client key file for --event-tls-cert-file",
+	)
+
+	eventBufferSize = fs.IntLong(
+		"event-buffer-size",
+		4096,
+		"Initial size in bytes of the event socket read buffer",
+	)
+
+	maxEventSize = fs.IntLong(
+		"max-event-size",
+		1024*1024,
+		"Maximum size in bytes of a single event",
+	)
+
+	workerCount = fs.IntLong(
+		"worker-count",
+		1,
+		"Number of goroutines handling events, events may be handled out of order when more than 1",
+	)
+
+	eventQueueSize = fs.IntLong(
+		"channel-buffer",
+		1000,
+		"Number of events to buffer for the workers, events are dropped when it is full",
+	)
+
+	sinkQueueSize = fs.IntLong(
+		"sink-queue-size",
+		1000,
+		"Number of writes to buffer for each sink, writes to a sink are dropped when its buffer is full",
+	)
+
+	batchSize = fs.IntLong(
+		"batch-size",
+		1,
+		"Number of samples to buffer before writing them in one request",
+	)
+
+	batchInterval = fs.DurationLong(
+		"batch-interval",
+		5*time.Second,
+		"Maximum time to buffer samples for when batching",
+	)
+
+	queueDir = fs.StringLong(
+		"queue-dir",
+		"",
+		"Directory to queue failed remote write requests in for replay",
+	)
+
+	queueMaxBytes = fs.Int64Long(
+		"queue-max-bytes",
+		1024*1024*1024,
+		"Maximum size of the remote write queue, oldest requests are evicted first",
+	)
+
+	versionLabel = fs.BoolLong(
+		"event-version-label",
+		"Add faucet_event_version label to emitted metrics",
+	)
+
+	eventIDMode = fs.StringEnumLong(
+		"event-id",
+		"Attach the faucet event_id to emitted metrics: none, exemplar, label",
+		"none",
+		"exemplar",
+		"label",
+	)
+
+	dpNameFallback = fs.StringLong(
+		"dp-name-fallback-prefix",
+		"dp_",
+		"Prefix for the dp_id used as dp_name when an event has no dp_name, empty to disable",
+	)
+
+	dpNameStrip = fs.StringLong(
+		"dp-name-strip-prefix",
+		"",
+		"Regular expression for a prefix to strip from the dp_name label",
+	)
+
+	metricsPrefix = fs.StringLong(
+		"metrics-prefix",
+		defaultMetricsPrefix,
+		"Prefix for the names of metrics built from events",
+	)
+
+	jobName = fs.StringLong(
+		"job",
+		binName,
+		"Job label to add to every remote written metric, empty for none",
+	)
+
+	instanceName = fs.StringLong(
+		"instance",
+		"",
+		"Instance label for every metric (default: the hostname)",
+	)
+
+	nameValidation = fs.StringEnumLong(
+		"name-validation",
+		"How to handle metric and label names: legacy to replace characters invalid in legacy prometheus names with underscores, utf8 to allow any UTF-8 name",
+		"legacy",
+		"utf8",
+	)
+
+	resolveEthTypes = fs.BoolLong(
+		"resolve-ethertypes",
+		"Add an eth_type_name label with the name of well known EtherTypes to L2 learn metrics",
+	)
+
+	dpNamePrefix = fs.StringLong(
+		"dp-name-prefix-label",
+		"",
+		"Label to put the prefix stripped from dp_name in, empty to discard it",
+	)
+
+	pauseUntil = fs.StringLong(
+		"reconnect-pause-until",
+		"",
+		"Pause event socket reconnection until this RFC3339 time, without closing an established connection",
+	)
+
+	l3HostTTL = fs.DurationLong(
+		"l3-host-ttl",
+		time.Hour,
+		"Time after which an unseen L3 host stops counting towards faucet_distinct_l3_hosts",
+	)
+
+	maxL3Hosts = fs.IntLong(
+		"max-l3-hosts",
+		0,
+		"Maximum number of L3 hosts tracked per datapath, dropping L3 learns for new hosts beyond it, 0 for no limit",
+	)
+
+	portNamesFile = fs.StringLong(
+		"port-names-file",
+		"",
+		"YAML file mapping datapath names and port numbers to port names",
+	)
+
+	relabelFile = fs.StringLong(
+		"relabel-config-file",
+		"",
+		"YAML file with a list of prometheus relabel configs to apply to every series before it is written",
+	)
+
+	vlanMapFile = fs.StringLong(
+		"vlan-map-file",
+		"",
+		"YAML file mapping VIDs to VLAN names",
+	)
+
+	auditLogFile = fs.StringLong(
+		"audit-log",
+		"",
+		"Path to write every decoded event to as JSON lines",
+	)
+
+	auditLogMaxSize = fs.Int64Long(
+		"audit-log-max-size",
+		100*1024*1024,
+		"Size in bytes at which the audit log is rotated",
+	)
+
+	auditLogBackups = fs.IntLong(
+		"audit-log-max-backups",
+		5,
+		"Number of rotated audit logs to keep",
+	)
+
+	auditLogFields = fs.StringListLong(
+		"audit-log-field",
+		"Event field to include in the audit log, may be repeated (default: all fields)",
+	)
+
+	oneshot = fs.BoolLong(
+		"oneshot",
+		"Write faucet_agent_build_info to each sink and exit, with a non-zero status if any write failed, without reading events",
+	)
+
+	heartbeatInterval = fs.DurationLong(
+		"heartbeat-interval",
+		time.Minute,
+		"Interval to push faucet_agent_up at, 0 to disable",
+	)
+
+	shutdownTimeout = fs.DurationLong(
+		"shutdown-timeout",
+		timeout,
+		"Time to spend writing out events already read and buffered samples on shutdown",
+	)
+
+	metricsAddress = fs.StringLong(
+		"metrics-listen-address",
+		":9816",
+		"Address to serve agent metrics on, empty to disable",
+	)
+
+	metricsFailFast = fs.BoolLong(
+		"metrics-listen-fail-fast",
+		"Exit if the metrics or health listen address can't be bound, instead of running without it",
+	)
+
+	healthAddress = fs.StringLong(
+		"health-listen-address",
+		"",
+		"Address to serve /healthz and /readyz on (default: the metrics listen address)",
+	)
+
+	metricsTLSCert = fs.StringLong(
+		"metrics-tls-cert-file",
+		"",
+		"Certificate file to serve the metrics and health endpoints over HTTPS with",
+	)
+
+	metricsTLSKey = fs.StringLong(
+		"metrics-tls-key-file",
+		"",
+		"Key file for --metrics-tls-cert-file",
+	)
+
+	metricsClientCA = fs.StringLong(
+		"metrics-tls-client-ca-file",
+		"",
+		"CA file to verify client certificates with, requiring one on every metrics and health request",
+	)
+
+	readyThreshold = fs.DurationLong(
+		"ready-write-threshold",
+		5*time.Minute,
+		"Time since the last successful remote write after which a failing agent is not ready",
+	)
+
+	flagSet = fs
+}
+
+// Parse the flags defined in init and set up logging. This is done from main
+// rather than init, so that tests can run with the default flag values.
+func configure() {
+	if err := parseFlags(flagSet, os.Args[1:]); err != nil {
+		printUsage(flagSet)
 	}
 
 	if *displayVersion {
@@ -108,231 +760,1302 @@ func init() {
 		slogLevel.Set(slog.LevelError)
 	}
 
-	logger := slog.New(
-		slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{
-			Level: slogLevel,
-		}),
-	)
-	slog.SetDefault(logger)
-}
+	handlerOptions := &slog.HandlerOptions{
+		AddSource: *logSource,
+		Level:     slogLevel,
+	}
 
-func handleEvent(ctx context.Context, promClient remote.WriteClient, eventString string) {
-	var event FaucetEvent
-	if err := json.Unmarshal([]byte(eventString), &event); err != nil {
-		slog.Error("Failed to parse JSON message", "message", eventString)
+	var handler slog.Handler
+	switch *logFormat {
+	case "text":
+		handler = slog.NewTextHandler(os.Stdout, handlerOptions)
+	case "json":
+		handler = slog.NewJSONHandler(os.Stdout, handlerOptions)
 	}
 
-	metrics := map[string]*dto.MetricFamily{}
+	logger := slog.New(newErrorRecorder(handler))
+	slog.SetDefault(logger)
+}
 
-	if event.L3Learn != nil {
-		slog.Debug(
-			"Received L3 learn event",
-			"timestamp",
-			time.UnixMilli(int64(event.Time*1000)),
-			"dp",
-			event.DpName,
-			"event",
-			event.L3Learn,
-		)
+// Remote write options that are applied again when the config is reloaded
+type remoteWriteFlags struct {
+	tlsCA          *string
+	tlsCert        *string
+	tlsKey         *string
+	tlsInsecure    *bool
+	username       *string
+	password       *string
+	passwordFile   *string
+	token          *string
+	tokenFile      *string
+	proxyURL       *string
+	headers        *[]string
+	externalLabels *[]string
+}
 
-		labels := []*dto.LabelPair{
-			{
-				Name:  proto.String("instance"),
-				Value: proto.String(hostname),
-			},
-			{
-				Name:  proto.String("dp_id"),
-				Value: proto.String(strconv.Itoa(event.DpID)),
-			},
-			{
-				Name:  proto.String("dp_name"),
-				Value: proto.String(event.DpName),
-			},
-			{
-				Name:  proto.String("mac"),
-				Value: proto.String(event.L3Learn.EthSrc),
-			},
-			{
-				Name:  proto.String("ip"),
-				Value: proto.String(event.L3Learn.L3SrcIP),
-			},
-			{
-				Name:  proto.String("port"),
-				Value: proto.String(strconv.Itoa(event.L3Learn.PortNo)),
-			},
-			{
-				Name:  proto.String("vid"),
-				Value: proto.String(strconv.Itoa(event.L3Learn.Vid)),
-			},
-		}
-
-		metrics["faucet_l3_info"] = &dto.MetricFamily{
-			Name: proto.String("faucet_l3_info"),
-			Type: dto.MetricType_COUNTER.Enum(),
-			Metric: []*dto.Metric{
-				{
-					Label: labels,
-					Untyped: &dto.Untyped{
-						Value: proto.Float64(1),
-					},
-					TimestampMs: proto.Int64(int64(event.Time * 1000)),
-				},
-			},
-		}
-	}
-
-	writeRequest, err := fmtutil.MetricFamiliesToWriteRequest(
-		metrics,
-		map[string]string{},
-	)
-	if err != nil {
-		log.Printf("Unable to format write request: %s", err)
+func addRemoteWriteFlags(fs *ff.FlagSet) *remoteWriteFlags {
+	return &remoteWriteFlags{
+		tlsCA: fs.StringLong(
+			"prometheus-tls-ca-file",
+			"",
+			"CA certificate file to verify the prometheus remote write server with",
+		),
+		tlsCert: fs.StringLong(
+			"prometheus-tls-cert-file",
+			"",
+			"Client certificate file for prometheus remote write",
+		),
+		tlsKey: fs.StringLong(
+			"prometheus-tls-key-file",
+			"",
+			"Client key file for prometheus remote write",
+		),
+		tlsInsecure: fs.BoolLong(
+			"prometheus-tls-insecure-skip-verify",
+			"Skip verification of the prometheus remote write server certificate",
+		),
+		username: fs.StringLong(
+			"prometheus-username",
+			"",
+			"Username for prometheus remote write basic auth",
+		),
+		password: fs.StringLong(
+			"prometheus-password",
+			"",
+			"Password for prometheus remote write basic auth",
+		),
+		passwordFile: fs.StringLong(
+			"prometheus-password-file",
+			"",
+			"File containing the password for prometheus remote write basic auth, read on every request",
+		),
+		token: fs.StringLong(
+			"prometheus-bearer-token",
+			"",
+			"Bearer token for prometheus remote write",
+		),
+		tokenFile: fs.StringLong(
+			"prometheus-bearer-token-file",
+			"",
+			"File containing a bearer token for prometheus remote write, read on every request",
+		),
+		proxyURL: fs.StringLong(
+			"prometheus-proxy-url",
+			"",
+			"HTTP proxy for prometheus remote write, instead of the proxy from HTTP_PROXY, HTTPS_PROXY and NO_PROXY",
+		),
+		headers: fs.StringListLong(
+			"prometheus-header",
+			"Header to add to remote write requests as Name=Value, may be repeated",
+		),
+		externalLabels: fs.StringListLong(
+			"external-label",
+			"Label to add to every remote written metric as name=value, overriding event labels, may be repeated",
+		),
 	}
+}
 
-	rawRequest, err := writeRequest.Marshal()
-	if err != nil {
-		log.Printf("Unable to marshal write request: %s", err)
+// Parse flags from the command line arguments, environment and config file
+func parseFlags(fs *ff.FlagSet, args []string) error {
+	options := []ff.Option{
+		ff.WithEnvVarPrefix(strings.ToUpper(binName)),
+		ff.WithConfigFileFlag("config"),
+		ff.WithConfigFileParser(ffyaml.Parse),
 	}
 
-	compressedRequest := snappy.Encode(nil, rawRequest)
-
-	_, err = promClient.Store(ctx, compressedRequest, 0)
-	if err != nil {
-		log.Printf("Unable to send write request to prometheus: %s", err)
+	// Environment variables are split on spaces to set repeatable flags,
+	// unless another separator is given with FAUCET_AGENT_ENV_SPLIT, or no
+	// separator at all if it is empty, for values that contain spaces
+	split, ok := os.LookupEnv(envVarSplit)
+	if !ok {
+		split = " "
+	}
+	if split != "" {
+		options = append(options, ff.WithEnvVarSplit(split))
 	}
+
+	return ff.Parse(fs, args, options...)
 }
 
-func socketConnect(ctx context.Context, socket string, promClient remote.WriteClient) {
-	var err error
+// Time of the last unsupported event version warning
+var lastVersionWarning atomic.Int64
 
-	conn, err = net.Dial("unix", socket)
-	if err != nil {
-		slog.Error("Failed to connect to unix socket", "socket", socket, "error", err.Error())
+// Count an event with an unsupported schema version, warning about it at
+// most once a minute
+func checkEventVersion(event FaucetEvent) {
+	unsupportedVersions.Inc()
 
+	now := time.Now().UnixNano()
+	last := lastVersionWarning.Load()
+	if now-last < int64(time.Minute) || !lastVersionWarning.CompareAndSwap(last, now) {
 		return
 	}
 
-	slog.Info("Connected to unix socket", "socket", socket)
+	slog.Warn(
+		"Event has an unsupported schema version, metrics may be missing or wrong",
+		"version",
+		event.Version,
+		"min_version",
+		minEventVersion,
+		"max_version",
+		maxEventVersion,
+	)
+}
 
-	scanner := bufio.NewScanner(conn)
+func handleEvent(ctx context.Context, sinks []MetricSink, eventString string) {
+	var event FaucetEvent
+	if err := json.Unmarshal([]byte(eventString), &event); err != nil {
+		slog.Error("Failed to parse JSON message", "message", eventString, "error", err.Error())
+		parseErrors.Inc()
+		eventsDropped.WithLabelValues(dropParseError).Inc()
 
-	for {
-		select {
-		case <-ctx.Done():
-			if conn != nil {
-				conn.Close()
-			}
+		return
+	}
 
-			return
-		default:
-			if scanner.Scan() {
-				handleEvent(ctx, promClient, scanner.Text())
-				retries = 0
-			} else if ctx.Err() != nil {
-				return
-			} else {
-				if err := scanner.Err(); err != nil {
-					slog.Error("Error reading from socket", "error", err.Error())
-				} else {
-					slog.Info("Got EOF from unix socket")
-				}
+	eventsReceived.WithLabelValues(event.Type()).Inc()
+	lastEventTime.Store(time.Now().UnixNano())
+	name, _ := dpNameLabel(event)
+	datapathLastEvent.WithLabelValues(name).SetToCurrentTime()
 
-				if conn != nil {
-					conn.Close()
-				}
+	if event.Version < minEventVersion || event.Version > maxEventVersion {
+		checkEventVersion(event)
+	}
 
-				return
-			}
+	if audit != nil {
+		if err := audit.record(event, time.Now()); err != nil {
+			slog.Error("Failed to write event to audit log", "error", err.Error())
 		}
 	}
-}
 
-func main() {
-	u, err := url.Parse(*promUrl)
-	if err != nil {
-		slog.Error(
-			"Failed to parse prometheus remote write uri",
-			"url",
-			*promUrl,
-			"error",
-			err.Error(),
-		)
-		os.Exit(1)
+	if allowedEventTypes != nil && !allowedEventTypes[event.Type()] {
+		eventsFiltered.WithLabelValues(event.Type()).Inc()
+		eventsDropped.WithLabelValues(dropFiltered).Inc()
+
+		return
 	}
 
-	hostname, err = os.Hostname()
-	if err != nil {
-		slog.Error(
-			"Failed to get system hostname",
-			"error",
-			err,
+	event.Time = eventTimeSeconds(event.Time)
+
+	if event.Time < minEventTime {
+		slog.Warn(
+			"Event has an invalid timestamp, using the current time",
+			"type",
+			event.Type(),
+			"event_id",
+			event.EventID,
+			"time",
+			event.Time,
 		)
-		os.Exit(1)
+		timestampFixups.Inc()
+
+		event.Time = float64(time.Now().UnixNano()) / float64(time.Second)
 	}
 
-	promClient, err := remote.NewWriteClient(binName, &remote.ClientConfig{
-		URL:     &prom_config.URL{URL: u},
-		Timeout: model.Duration(timeout),
-	})
-	if err != nil {
-		slog.Error("Failed to create prometheus remote write client", "error", err.Error())
-		os.Exit(1)
+	if len(eventSinks) > 0 {
+		writeEvent(ctx, eventSinks, event)
 	}
 
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
+	// Dropped after the event sinks, which keep every event
+	if event.Type() == "UNKNOWN" {
+		slog.Debug("Dropping event of an unknown type", "event_id", event.EventID)
+		eventsDropped.WithLabelValues(dropUnknownType).Inc()
 
-	exitSignal := make(chan os.Signal, 1)
-	signal.Notify(exitSignal, os.Interrupt, syscall.SIGTERM)
+		return
+	}
 
-	go func() {
-		<-exitSignal
-		slog.Info("Cleaning up and exiting")
-		cancel()
-		if conn != nil {
-			conn.Close()
-		}
-	}()
+	// Sampled after the event sinks, which keep every event
+	if rate, ok := eventSampleRates[event.Type()]; ok && rand.Float64() >= rate {
+		eventsSampledOut.WithLabelValues(event.Type()).Inc()
+		eventsDropped.WithLabelValues(dropSampled).Inc()
 
-	retries = 0
+		return
+	}
+
+	metrics := eventToMetricFamilies(event)
+
+	if staleness != nil {
+		staleness.observe(metrics)
+	}
+
+	// After the staleness tracker, so that repeated series don't go stale
+	if dedup != nil {
+		if suppressed := dedup.filter(metrics, time.Now()); suppressed > 0 {
+			eventsDeduplicated.WithLabelValues(event.Type()).Inc()
+			eventsDropped.WithLabelValues(dropDeduplicated).Add(float64(suppressed))
+		}
+	}
+
+	emitMetrics(ctx, sinks, metrics)
+}
+
+// Split an event socket into the network and address to dial. Sockets may be
+// given as unix:///path or tcp://host:port, a bare path is a unix socket.
+func parseEventSocket(socket string) (string, string, error) {
+	if path, ok := strings.CutPrefix(socket, "unix://"); ok {
+		return "unix", path, nil
+	}
+
+	if address, ok := strings.CutPrefix(socket, "tcp://"); ok {
+		if _, _, err := net.SplitHostPort(address); err != nil {
+			return "", "", err
+		}
+
+		return "tcp", address, nil
+	}
+
+	if strings.Contains(socket, "://") {
+		return "", "", fmt.Errorf("unsupported event socket scheme in %q", socket)
+	}
+
+	return "unix", socket, nil
+}
+
+// Read events from a socket until the connection is lost, returning whether
+// the connection was healthy, meaning it stayed up for at least
+// --min-healthy-duration. A quiet connection that stays up is healthy even if
+// faucet sent no events on it.
+func socketConnect(ctx context.Context, c *eventConnection, workers *eventWorkers) bool {
+	socket := c.socket
+
+	network, address, err := parseEventSocket(socket)
+	if err != nil {
+		slog.Error("Invalid event socket", "socket", socket, "error", err.Error())
+
+		return false
+	}
+
+	dialer := &net.Dialer{Timeout: timeout}
+
+	conn, err := dialer.DialContext(ctx, network, address)
+	if err != nil {
+		slog.Error("Failed to connect to event socket", "socket", socket, "error", err.Error())
+		socketConnected.WithLabelValues(socket).Set(0)
+
+		return false
+	}
+	defer conn.Close()
+
+	if eventTLSConfig != nil && network == "tcp" {
+		tlsConn, err := tlsHandshake(ctx, conn, address)
+		if err != nil {
+			slog.Error("Failed TLS handshake with event socket", "socket", socket, "error", err.Error())
+			socketConnected.WithLabelValues(socket).Set(0)
+
+			return false
+		}
+
+		// Closing the underlying connection on return is enough, without
+		// waiting to send a close notification
+		conn = tlsConn
+	}
+
+	c.setConn(conn)
+
+	slog.Info("Connected to event socket", "socket", socket)
+	slog.LogAttrs(
+		ctx,
+		slog.LevelInfo,
+		"Event socket configuration",
+		append([]slog.Attr{slog.String("socket", socket)}, configSummary...)...,
+	)
+
+	connectedAt := time.Now()
+
+	socketConnected.WithLabelValues(socket).Set(1)
+	defer socketConnected.WithLabelValues(socket).Set(0)
+
+	socketLastConnect.WithLabelValues(socket).SetToCurrentTime()
+	defer socketLastDisconnect.WithLabelValues(socket).SetToCurrentTime()
+
+	connectedSockets.Add(1)
+	defer connectedSockets.Add(-1)
+
+	if *watchSocket && network == "unix" {
+		stop := c.watchSocketFile(ctx, address)
+		defer stop()
+	}
+
+	var reader io.Reader = conn
+	if *readTimeout > 0 {
+		reader = deadlineReader{conn: conn, timeout: *readTimeout}
+	}
+
+	// Counted before decompression, as read from the socket
+	reader = countingReader{reader: reader, bytes: socketBytesRead.WithLabelValues(socket)}
+
+	if *eventCompress == "gzip" {
+		// Blocks until the gzip header has been read
+		gzipReader, err := gzip.NewReader(reader)
+		if err != nil {
+			if ctx.Err() == nil && !c.replaced.Load() {
+				slog.Error("Failed to decompress event socket stream", "socket", socket, "error", err.Error())
+			}
+
+			return false
+		}
+		defer gzipReader.Close()
+
+		reader = gzipReader
+	}
+
+	scanner := newEventScanner(reader)
+	processed := socketEventsProcessed.WithLabelValues(socket)
+
+	for scanner.Scan() {
+		workers.offer(scanner.Text())
+		processed.Inc()
+	}
+
+	healthy := time.Since(connectedAt) >= *minHealthy
+
+	if ctx.Err() != nil || c.replaced.Load() {
+		return healthy
+	}
+
+	if err := scanner.Err(); errors.Is(err, os.ErrDeadlineExceeded) {
+		slog.Warn(
+			"Nothing read from event socket within read timeout, reconnecting",
+			"socket",
+			socket,
+			"timeout",
+			*readTimeout,
+		)
+	} else if err != nil {
+		slog.Error("Error reading from event socket", "socket", socket, "error", err.Error())
+	} else {
+		slog.Info("Got EOF from event socket", "socket", socket)
+	}
+
+	return healthy
+}
+
+// Create a scanner for newline delimited events. Events larger than
+// --max-event-size are skipped instead of stopping the scanner.
+func newEventScanner(r io.Reader) *bufio.Scanner {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(
+		make([]byte, 0, min(*eventBufferSize, *maxEventSize)),
+		*maxEventSize,
+	)
+
+	var skipper oversizedEventSkipper
+	scanner.Split(skipper.split)
+
+	return scanner
+}
+
+// Split function that splits lines like bufio.ScanLines, but discards a line
+// once it fills the scanner's buffer, and then everything up to the next
+// newline, so that the events after it can still be read
+type oversizedEventSkipper struct {
+	skipping bool
+}
+
+func (s *oversizedEventSkipper) split(data []byte, atEOF bool) (int, []byte, error) {
+	if s.skipping {
+		i := bytes.IndexByte(data, '\n')
+		if i < 0 {
+			return len(data), nil, nil
+		}
+
+		s.skipping = false
+
+		return i + 1, nil, nil
+	}
+
+	advance, token, err := bufio.ScanLines(data, atEOF)
+	if advance == 0 && token == nil && err == nil && len(data) >= *maxEventSize {
+		logEventTooLong()
+		oversizedEvents.Inc()
+		eventsDropped.WithLabelValues(dropOversized).Inc()
+
+		s.skipping = true
+
+		return len(data), nil, nil
+	}
+
+	return advance, token, err
+}
+
+func logEventTooLong() {
+	slog.Error(
+		"Skipping event larger than maximum event size, increase --max-event-size",
+		"max_event_size",
+		*maxEventSize,
+	)
+}
+
+// Read events from a file, or stdin if path is -, until EOF
+func readEventFile(ctx context.Context, path string, workers *eventWorkers) error {
+	file := os.Stdin
+	if path != "-" {
+		var err error
+
+		file, err = os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+	}
+
+	scanner := newEventScanner(file)
+	for scanner.Scan() {
+		if ctx.Err() != nil {
+			return nil
+		}
+
+		workers.submit(ctx, scanner.Text())
+	}
+
+	return scanner.Err()
+}
+
+// Summarize the effective configuration for the connection log, to help
+// debug a misconfigured agent without debug logging. Credentials are never
+// included, only which kind of authentication is used.
+func summarizeConfig(sinks []MetricSink) []slog.Attr {
+	sinkNames := []string{}
+	for _, sink := range sinks {
+		sinkNames = append(sinkNames, sink.Name())
+	}
+	for _, sink := range eventSinks {
+		sinkNames = append(sinkNames, sink.Name())
+	}
+
+	promURLs := []string{}
+	for _, promURL := range *promUrls {
+		promURLs = append(promURLs, redactURL(promURL))
+	}
+
+	auth := "none"
+	if *promFlags.username != "" || *promFlags.password != "" || *promFlags.passwordFile != "" {
+		auth = "basic"
+	} else if *promFlags.token != "" || *promFlags.tokenFile != "" {
+		auth = "bearer"
+	}
+
+	types := []string{"all"}
+	if allowedEventTypes != nil {
+		types = slices.Sorted(maps.Keys(allowedEventTypes))
+	}
+
+	return []slog.Attr{
+		slog.String("mode", *mode),
+		slog.Any("sinks", sinkNames),
+		slog.Any("prometheus_urls", promURLs),
+		slog.String("auth", auth),
+		slog.Any("event_types", types),
+		slog.Bool("dry_run", *dryRun),
+	}
+}
+
+// Redact the password and query parameter values in a URL, since either may
+// hold a credential
+func redactURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "invalid"
+	}
+
+	if u.RawQuery != "" {
+		query := u.Query()
+		for key := range query {
+			query.Set(key, "xxxxx")
+		}
+		u.RawQuery = query.Encode()
+	}
+
+	return u.Redacted()
+}
+
+// Serve HTTP on an address, exiting if it can't be bound and fail fast is
+// enabled, otherwise carrying on without it
+func listenOrExit(
+	ctx context.Context,
+	name string,
+	address string,
+	handler http.Handler,
+	tlsConfig *tls.Config,
+) {
+	if err := serveHTTP(ctx, address, handler, tlsConfig); err != nil {
+		slog.Error(
+			"Failed to listen on "+name+" address",
+			"address",
+			address,
+			"error",
+			err.Error(),
+		)
+
+		if *metricsFailFast {
+			os.Exit(1)
+		}
+
+		slog.Warn("Continuing without " + name + " endpoint")
+	}
+}
+
+func main() {
+	configure()
+
+	if *eventBufferSize < 1 {
+		slog.Error("Event buffer size must be positive", "size", *eventBufferSize)
+		os.Exit(1)
+	}
+
+	if *maxEventSize < 1 {
+		slog.Error("Maximum event size must be positive", "size", *maxEventSize)
+		os.Exit(1)
+	}
+
+	if *workerCount < 1 {
+		slog.Error("Worker count must be positive", "count", *workerCount)
+		os.Exit(1)
+	}
+
+	if *eventQueueSize < 0 {
+		slog.Error("Channel buffer must not be negative", "size", *eventQueueSize)
+		os.Exit(1)
+	}
+
+	if *sinkQueueSize < 1 {
+		slog.Error("Sink queue size must be positive", "size", *sinkQueueSize)
+		os.Exit(1)
+	}
+
+	for _, types := range *eventTypes {
+		for _, eventType := range strings.Split(types, ",") {
+			eventType = strings.ToUpper(strings.TrimSpace(eventType))
+			if !slices.Contains(eventTypeNames, eventType) {
+				slog.Error("Unknown event type", "type", eventType, "valid", eventTypeNames)
+				os.Exit(1)
+			}
+
+			if allowedEventTypes == nil {
+				allowedEventTypes = map[string]bool{}
+			}
+			allowedEventTypes[eventType] = true
+		}
+	}
+
+	for _, pair := range *sampleRates {
+		eventType, value, _ := strings.Cut(pair, "=")
+		eventType = strings.ToUpper(strings.TrimSpace(eventType))
+
+		// Other event types are rare and each one matters
+		if eventType != "L2_LEARN" && eventType != "L3_LEARN" {
+			slog.Error("Only L2_LEARN and L3_LEARN events can be sampled", "sample_rate", pair)
+			os.Exit(1)
+		}
+
+		rate, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+		if err != nil || rate < 0 || rate > 1 {
+			slog.Error("Sample rate must be a fraction between 0 and 1", "sample_rate", pair)
+			os.Exit(1)
+		}
+
+		if eventSampleRates == nil {
+			eventSampleRates = map[string]float64{}
+		}
+		eventSampleRates[eventType] = rate
+	}
+
+	droppedLabels = parseLabelList(*dropLabels)
+	keptLabels = parseLabelList(*keepLabels)
+
+	if *debugSampleRate < 1 {
+		slog.Error("Debug log sample rate must be at least 1", "rate", *debugSampleRate)
+		os.Exit(1)
+	}
+
+	if *promTimeout <= 0 {
+		slog.Error("Remote write timeout must be positive", "timeout", *promTimeout)
+		os.Exit(1)
+	}
+
+	if *maxRequestRate < 0 || *maxBurst < 1 {
+		slog.Error(
+			"Maximum requests per second must not be negative and maximum burst must be at least 1",
+			"max_requests_per_second",
+			*maxRequestRate,
+			"max_burst",
+			*maxBurst,
+		)
+		os.Exit(1)
+	}
+
+	if *readTimeout < 0 {
+		slog.Error("Event read timeout must not be negative", "timeout", *readTimeout)
+		os.Exit(1)
+	}
+
+	if *minHealthy < 0 {
+		slog.Error("Minimum healthy duration must not be negative", "min_healthy_duration", *minHealthy)
+		os.Exit(1)
+	}
+
+	if (*metricsTLSCert == "") != (*metricsTLSKey == "") {
+		slog.Error("Metrics TLS certificate and key files must be set together")
+		os.Exit(1)
+	}
+
+	if (*eventTLSCert == "") != (*eventTLSKey == "") {
+		slog.Error("Event TLS certificate and key files must be set together")
+		os.Exit(1)
+	}
+
+	if *metricsClientCA != "" && *metricsTLSCert == "" {
+		slog.Error("Metrics TLS client CA file needs a certificate and key file to serve HTTPS with")
+		os.Exit(1)
+	}
+
+	if *dedupWindow < 0 || *dedupMaxEntries < 1 {
+		slog.Error(
+			"Dedup window must not be negative and dedup max entries must be at least 1",
+			"dedup_window",
+			*dedupWindow,
+			"dedup_max_entries",
+			*dedupMaxEntries,
+		)
+		os.Exit(1)
+	}
+
+	if *maxL3Hosts < 0 {
+		slog.Error("Maximum L3 hosts must not be negative", "max_l3_hosts", *maxL3Hosts)
+		os.Exit(1)
+	}
+
+	if *maxReconnects < 0 {
+		slog.Error("Maximum reconnect attempts must not be negative", "max_reconnect_attempts", *maxReconnects)
+		os.Exit(1)
+	}
+
+	if *maxReqSamples < 0 {
+		slog.Error("Maximum request samples must not be negative", "max_request_samples", *maxReqSamples)
+		os.Exit(1)
+	}
+
+	if *maxSampleAge < 0 {
+		slog.Error("Maximum sample age must not be negative", "max_sample_age", *maxSampleAge)
+		os.Exit(1)
+	}
+
+	if *initialBackoff < 0 || *maxBackoff < *initialBackoff || *backoffJitter < 0 {
+		slog.Error(
+			"Backoff and jitter must not be negative and maximum backoff must not be less than initial backoff",
+			"initial_backoff",
+			*initialBackoff,
+			"max_backoff",
+			*maxBackoff,
+			"backoff_jitter",
+			*backoffJitter,
+		)
+		os.Exit(1)
+	}
+
+	if len(*eventSockets) == 0 {
+		*eventSockets = []string{defaultEventSocket}
+	}
+
+	for _, socket := range *eventSockets {
+		if _, _, err := parseEventSocket(socket); err != nil {
+			slog.Error("Invalid event socket", "socket", socket, "error", err.Error())
+			os.Exit(1)
+		}
+	}
+
+	if len(*sinkTypes) == 0 {
+		*sinkTypes = []string{"remote-write"}
+	}
+
+	for _, sinkType := range *sinkTypes {
+		if !slices.Contains(sinkTypeNames, sinkType) {
+			slog.Error("Unknown sink", "sink", sinkType, "valid", sinkTypeNames)
+			os.Exit(1)
+		}
+	}
+
+	if slices.Contains(*sinkTypes, "kafka") {
+		var brokers []string
+		for _, list := range *kafkaBrokers {
+			for _, broker := range strings.Split(list, ",") {
+				if broker = strings.TrimSpace(broker); broker != "" {
+					brokers = append(brokers, broker)
+				}
+			}
+		}
+
+		if len(brokers) == 0 {
+			slog.Error("Kafka sink requires at least one broker, set --kafka-brokers")
+			os.Exit(1)
+		}
+
+		if *kafkaRetries < 0 {
+			slog.Error("Kafka retries must not be negative", "retries", *kafkaRetries)
+			os.Exit(1)
+		}
+
+		if *kafkaTimeout <= 0 {
+			slog.Error("Kafka timeout must be positive", "timeout", *kafkaTimeout)
+			os.Exit(1)
+		}
+
+		sink := newKafkaSink(brokers, *kafkaTopic, *kafkaTimeout)
+		defer sink.Close()
+
+		eventSinks = append(eventSinks, sink)
+	}
+
+	if slices.Contains(*sinkTypes, "file") {
+		if *filePath == "" {
+			slog.Error("File sink requires a path, set --file-path")
+			os.Exit(1)
+		}
+
+		if *fileMaxSize < 0 || *fileMaxAge < 0 || *fileMaxBackups < 0 {
+			slog.Error(
+				"File sink rotation limits must not be negative",
+				"max_size",
+				*fileMaxSize,
+				"max_age",
+				*fileMaxAge,
+				"max_backups",
+				*fileMaxBackups,
+			)
+			os.Exit(1)
+		}
+
+		file, err := newRotatingFile(*filePath, *fileMaxSize, *fileMaxAge, *fileMaxBackups)
+		if err != nil {
+			slog.Error(
+				"Failed to open event file sink",
+				"file",
+				*filePath,
+				"error",
+				err.Error(),
+			)
+			os.Exit(1)
+		}
+		defer file.Close()
+
+		eventSinks = append(eventSinks, newFileSink(file))
+	}
+
+	if len(*promUrls) == 0 && *mode == "remote-write" && slices.Contains(*sinkTypes, "remote-write") {
+		*promUrls = []string{defaultPromUrl}
+	}
+
+	var err error
+
+	hostname, err = os.Hostname()
+	if err != nil {
+		slog.Error(
+			"Failed to get system hostname",
+			"error",
+			err,
+		)
+		os.Exit(1)
+	}
+
+	if *instanceName != "" {
+		hostname = *instanceName
+	}
+
+	labels, err := parseExternalLabels(*promFlags.externalLabels)
+	if err != nil {
+		slog.Error("Invalid external label", "error", err.Error())
+		os.Exit(1)
+	}
+	externalLabels.Store(&labels)
+
+	eventTLSConfig, err = eventSocketTLSConfig(*eventTLSCA, *eventTLSCert, *eventTLSKey)
+	if err != nil {
+		slog.Error("Unable to load event socket TLS configuration", "error", err.Error())
+		os.Exit(1)
+	}
+
+	sinks := []MetricSink{}
+
+	if *mode == "scrape" {
+		if *metricsAddress == "" {
+			slog.Error("Scrape mode requires a metrics listen address")
+			os.Exit(1)
+		}
+
+		scrapeMetrics = newScrapeSink(*scrapeTTL)
+		sinks = append(sinks, scrapeMetrics)
+		*promUrls = nil
+	} else {
+		if slices.Contains(*sinkTypes, "otlp") {
+			u, err := url.Parse(*otlpEndpoint)
+			if err != nil {
+				slog.Error(
+					"Failed to parse OTLP endpoint",
+					"url",
+					*otlpEndpoint,
+					"error",
+					err.Error(),
+				)
+				os.Exit(1)
+			}
+
+			sinks = append(sinks, newOTLPSink(u))
+		}
+
+		if slices.Contains(*sinkTypes, "pushgateway") {
+			sinks = append(sinks, newPushgatewaySink(*pushgatewayURL, *pushgatewayJob, *scrapeTTL))
+		}
+
+		if !slices.Contains(*sinkTypes, "remote-write") {
+			*promUrls = nil
+		}
+	}
+
+	for _, promUrl := range *promUrls {
+		u, err := url.Parse(promUrl)
+		if err != nil {
+			slog.Error(
+				"Failed to parse prometheus remote write uri",
+				"url",
+				promUrl,
+				"error",
+				err.Error(),
+			)
+			os.Exit(1)
+		}
+
+		version := *promVersion
+		if version == remoteWriteAuto {
+			version = remoteWriteV1
+			if !*dryRun {
+				version = detectRemoteWriteVersion(context.Background(), u, promFlags)
+			}
+		}
+
+		promClient, err := newRemoteWriteClient(u, promFlags, version)
+		if err != nil {
+			slog.Error("Failed to create prometheus remote write client", "error", err.Error())
+			os.Exit(1)
+		}
+
+		name := "remote_write:" + u.Host
+
+		var queue *diskQueue
+		if *queueDir != "" {
+			queue, err = newDiskQueue(*queueDir, name, *queueMaxBytes)
+			if err != nil {
+				slog.Error(
+					"Failed to open remote write queue",
+					"dir",
+					*queueDir,
+					"error",
+					err.Error(),
+				)
+				os.Exit(1)
+			}
+		}
+
+		sinks = append(sinks, newRemoteWriteSink(name, u, version, promClient, labels, queue))
+	}
+
+	if *dpNameStrip != "" {
+		dpNameStripRegexp, err = regexp.Compile("^(?:" + *dpNameStrip + ")")
+		if err != nil {
+			slog.Error(
+				"Failed to parse dp name strip prefix",
+				"regexp",
+				*dpNameStrip,
+				"error",
+				err.Error(),
+			)
+			os.Exit(1)
+		}
+	}
+
+	if *relabelFile != "" {
+		relabelConfigs, err = loadRelabelConfigs(*relabelFile)
+		if err != nil {
+			slog.Error(
+				"Failed to load relabel config file",
+				"file",
+				*relabelFile,
+				"error",
+				err.Error(),
+			)
+			os.Exit(1)
+		}
+	}
+
+	if *portNamesFile != "" {
+		portNames, err = loadPortNames(*portNamesFile)
+		if err != nil {
+			slog.Error(
+				"Failed to load port names file",
+				"file",
+				*portNamesFile,
+				"error",
+				err.Error(),
+			)
+			os.Exit(1)
+		}
+	}
+
+	if *vlanMapFile != "" {
+		vlanNames, err = loadVLANNames(*vlanMapFile)
+		if err != nil {
+			slog.Error(
+				"Failed to load VLAN map file",
+				"file",
+				*vlanMapFile,
+				"error",
+				err.Error(),
+			)
+			os.Exit(1)
+		}
+	}
+
+	if *oneshot {
+		if len(sinks) == 0 || *mode == "scrape" {
+			slog.Error("Oneshot requires a metric sink in remote-write mode")
+			os.Exit(1)
+		}
+
+		if !writeBuildInfo(context.Background(), sinks) {
+			os.Exit(1)
+		}
+
+		return
+	}
+
+	if *auditLogFile != "" {
+		if *auditLogMaxSize < 0 || *auditLogBackups < 0 {
+			slog.Error(
+				"Audit log rotation limits must not be negative",
+				"max_size",
+				*auditLogMaxSize,
+				"max_backups",
+				*auditLogBackups,
+			)
+			os.Exit(1)
+		}
+
+		prevHash, err := lastAuditHash(*auditLogFile)
+		if err != nil {
+			slog.Error(
+				"Failed to read the existing audit log",
+				"file",
+				*auditLogFile,
+				"error",
+				err.Error(),
+			)
+			os.Exit(1)
+		}
+
+		file, err := newRotatingFile(*auditLogFile, *auditLogMaxSize, 0, *auditLogBackups)
+		if err != nil {
+			slog.Error(
+				"Failed to open audit log",
+				"file",
+				*auditLogFile,
+				"error",
+				err.Error(),
+			)
+			os.Exit(1)
+		}
+		defer file.Close()
+
+		audit = newAuditLog(file, *auditLogFields, prevHash)
+	}
+
+	l3Hosts = newHostTracker(*l3HostTTL, *maxL3Hosts)
+
+	if *metricTTL > 0 && *mode == "remote-write" {
+		staleness = newStalenessTracker(*metricTTL)
+	}
+
+	if *dedupWindow > 0 {
+		dedup = newDedupTracker(*dedupWindow, *dedupMaxEntries)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// A dry run leaves the queue alone, since replaying it would send the
+	// queued requests to the receiver
+	for _, sink := range sinks {
+		if rw, ok := sink.(*remoteWriteSink); ok && rw.queue != nil && !*dryRun {
+			go rw.queue.replay(ctx, rw.writeClient, rw.limiter)
+		}
+	}
+
+	// Writes outlive ctx so that events already read can be written out on
+	// shutdown, until the shutdown timeout
+	writeCtx, cancelWrites := context.WithCancel(context.Background())
+	defer cancelWrites()
+
+	// Registered before the batch and the workers, so that their last writes
+	// are queued before the queues are stopped
+	stopSinks := startSinkQueues(writeCtx, sinks, eventSinks)
+	defer stopSinks()
+
+	// Wait for buffered samples to be written
+	flushBatch := func() {}
+
+	if *batchSize > 1 {
+		metricBatch = newMetricBatcher(sinks, *batchSize)
+
+		stopBatch := make(chan struct{})
+		batchDone := make(chan struct{})
+		flushBatch = func() {
+			close(stopBatch)
+			<-batchDone
+		}
+		defer flushBatch()
+
+		go func() {
+			metricBatch.run(writeCtx, stopBatch, *batchInterval)
+			close(batchDone)
+		}()
+	}
+
+	configSummary = summarizeConfig(sinks)
+
+	workers := startEventWorkers(writeCtx, sinks, *workerCount, *eventQueueSize)
+	defer workers.stop()
+
+	go sampleEventRate(ctx)
+
+	if *heartbeatInterval > 0 {
+		go runHeartbeat(ctx, sinks, *heartbeatInterval)
+	}
+
+	if staleness != nil {
+		go staleness.run(ctx, sinks)
+	}
+
+	if *stateTTL > 0 {
+		go expireEventState(ctx, *stateTTL)
+	}
+
+	metricsMux := selfMetricsHandler()
+
+	metricsTLS, err := metricsTLSConfig(*metricsTLSCert, *metricsTLSKey, *metricsClientCA)
+	if err != nil {
+		slog.Error("Unable to load metrics TLS configuration", "error", err.Error())
+		os.Exit(1)
+	}
+
+	if *healthAddress == "" || *healthAddress == *metricsAddress {
+		registerHealthHandlers(metricsMux)
+	} else {
+		healthMux := http.NewServeMux()
+		registerHealthHandlers(healthMux)
+		listenOrExit(ctx, "health", *healthAddress, healthMux, metricsTLS)
+	}
+
+	if *metricsAddress != "" {
+		listenOrExit(ctx, "metrics", *metricsAddress, metricsMux, metricsTLS)
+	}
+
+	exitSignal := make(chan os.Signal, 1)
+	signal.Notify(exitSignal, os.Interrupt, syscall.SIGTERM)
+
+	go shutdownOnSignal(exitSignal, cancel, cancelWrites)
+
+	if *pauseUntil != "" {
+		until, err := time.Parse(time.RFC3339, *pauseUntil)
+		if err != nil {
+			slog.Error(
+				"Failed to parse reconnect pause time",
+				"time",
+				*pauseUntil,
+				"error",
+				err.Error(),
+			)
+			os.Exit(1)
+		}
+
+		reconnectPausedUntil.Store(until.UnixNano())
+	}
+
+	reloadSignal := make(chan os.Signal, 1)
+	signal.Notify(reloadSignal, syscall.SIGHUP)
+
+	go func() {
+		for range reloadSignal {
+			if err := reloadConfig(sinks); err != nil {
+				slog.Error("Failed to reload config, keeping the current config", "error", err.Error())
+			} else {
+				slog.Info("Reloaded config")
+			}
+
+			reopenFileSinks()
+		}
+	}()
+
+	pauseSignal := make(chan os.Signal, 1)
+	signal.Notify(pauseSignal, syscall.SIGUSR2)
+
+	go func() {
+		for range pauseSignal {
+			toggleReconnectPause()
+		}
+	}()
+
+	if *eventFile != "" {
+		if err := readEventFile(ctx, *eventFile, workers); err != nil {
+			slog.Error("Failed to read event file", "file", *eventFile, "error", err.Error())
+			workers.stop()
+			flushBatch()
+			stopSinks()
+			os.Exit(1)
+		} else if ctx.Err() != nil {
+			slog.Info("Stopped reading event file before the end on shutdown", "file", *eventFile)
+		} else {
+			slog.Info("Finished reading event file", "file", *eventFile)
+		}
+
+		return
+	}
+
+	var wg sync.WaitGroup
+	var failed atomic.Bool
+
+	for _, socket := range *eventSockets {
+		wg.Go(func() {
+			if err := readEventSocket(ctx, sinks, socket, workers); err != nil {
+				slog.Error("Giving up on event socket", "socket", socket, "error", err.Error())
+				failed.Store(true)
+
+				// Stop reading the other sockets too, so that the
+				// failure isn't hidden
+				cancel()
+				eventConnections.closeAll()
+			}
+		})
+	}
+
+	wg.Wait()
+
+	if failed.Load() {
+		workers.stop()
+		flushBatch()
+		stopSinks()
+		os.Exit(1)
+	}
+}
+
+// Wait for an exit signal, then stop reading events by cancelling the read
+// context and closing the event sockets. Events already read are still
+// written until the shutdown timeout, when the writes are cancelled too.
+func shutdownOnSignal(exitSignal <-chan os.Signal, cancel context.CancelFunc, cancelWrites context.CancelFunc) {
+	<-exitSignal
+	slog.Info("Cleaning up and exiting", "timeout", *shutdownTimeout)
+	cancel()
+	eventConnections.closeAll()
+
+	time.AfterFunc(*shutdownTimeout, func() {
+		slog.Warn("Shutdown timeout reached, abandoning unwritten metrics")
+		cancelWrites()
+	})
+}
+
+// Read events from a socket until the context is cancelled, reconnecting with
+// backoff whenever the connection is lost. Returns an error once
+// --max-reconnect-attempts consecutive attempts have failed.
+func readEventSocket(ctx context.Context, sinks []MetricSink, socket string, workers *eventWorkers) error {
+	c := eventConnections.add(socket)
+	connected := false
 
 	for {
 		select {
 		case <-ctx.Done():
-			return
+			return nil
 		default:
-			socketConnect(ctx, *eventSocket, promClient)
+			if waitWhilePaused(ctx, sinks) {
+				c.retries = 0
+			}
+			if ctx.Err() != nil {
+				return nil
+			}
+
+			if connected {
+				socketReconnects.WithLabelValues(socket).Inc()
+			}
+			connected = true
+
+			if socketConnect(ctx, c, workers) {
+				c.retries = 0
+			}
+
+			// The new socket is already there, so there's no need to wait
+			if c.replaced.Swap(false) {
+				slog.Info("Event socket file was replaced, reconnecting", "socket", socket)
+				c.retries = 0
+
+				continue
+			}
+
+			if ctx.Err() == nil && !reconnectPaused() {
+				if *maxReconnects > 0 && c.retries+1 >= *maxReconnects {
+					return fmt.Errorf("%d consecutive connection attempts failed", c.retries+1)
+				}
 
-			if ctx.Err() == nil {
 				slog.Info(
 					"Waiting before reconnecting to event socket",
+					"socket",
+					socket,
 					"retries",
-					retries,
+					c.retries,
 					"backoff",
-					backoff(initialBackoff, maxBackoff, retries),
+					backoff(*initialBackoff, *maxBackoff, c.retries),
 				)
 
-				backoffDelay(ctx, backoff(initialBackoff, maxBackoff, retries))
+				backoffDelay(ctx, backoff(*initialBackoff, *maxBackoff, c.retries))
 
-				retries++
+				c.retries++
 			}
 		}
 	}
 }
 
 func backoff(initial time.Duration, maximum time.Duration, retries int) time.Duration {
-	expo := int(math.Pow(2, float64(retries)))
+	jitter := *backoffJitter
+	if *noBackoffJitter {
+		jitter = 0
+	}
+
+	return jitteredBackoff(initial, maximum, retries, jitter, rand.Int63n)
+}
 
-	half := int(expo / 2)
+// Back off exponentially from initial, adding a random jitter from randn of
+// up to the jitter fraction of the exponential part, capped at maximum. randn
+// can be replaced to make the delay deterministic.
+func jitteredBackoff(
+	initial time.Duration,
+	maximum time.Duration,
+	retries int,
+	jitter float64,
+	randn func(int64) int64,
+) time.Duration {
+	// Stop doubling once past the maximum, so the delay can't overflow
+	expo := time.Second
+	for range retries {
+		if initial+expo >= maximum {
+			break
+		}
+		expo *= 2
+	}
 
-	random := 0
-	if half >= 1 {
-		random = rand.Intn(half)
+	var random time.Duration
+	if n := int64(float64(expo) * jitter); n >= 1 {
+		random = time.Duration(randn(n))
 	}
 
-	return min((initial + time.Duration(expo+random)*time.Second), maximum)
+	return min(initial+expo+random, maximum)
 }
 
+// Wait for the backoff delay or until the context is cancelled. Timers run
+// on the monotonic clock, so wall clock steps from NTP don't affect the delay.
 func backoffDelay(ctx context.Context, delay time.Duration) {
 	timer := time.NewTimer(delay)
 	select {
@@ -0,0 +1,413 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/peterbourgon/ff/v4"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"go.uber.org/goleak"
+	"golang.org/x/exp/rand"
+	"google.golang.org/protobuf/proto"
+)
+
+// Counts the writes made to it, blocking each one until released
+type blockingSink struct {
+	release chan struct{}
+	mu      sync.Mutex
+	writes  int
+}
+
+func (s *blockingSink) Name() string {
+	return "blocking"
+}
+
+func (s *blockingSink) Write(ctx context.Context, metrics map[string]*dto.MetricFamily) error {
+	select {
+	case <-s.release:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.writes++
+
+	return nil
+}
+
+// Wait for a condition to become true, failing the test after a few seconds
+func waitFor(t *testing.T, what string, condition func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestShutdownDrainsEventsOnSIGTERM(t *testing.T) {
+	defer goleak.VerifyNone(
+		t,
+		goleak.IgnoreCurrent(),
+		// Started by signal.Notify and kept for the life of the process
+		goleak.IgnoreTopFunction("os/signal.signal_recv"),
+	)
+
+	const events = 5
+
+	socket := filepath.Join(t.TempDir(), "event.sock")
+
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	// Closed once the agent has closed its end of the connection
+	closed := make(chan struct{})
+
+	go func() {
+		defer close(closed)
+
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		writer := bufio.NewWriter(conn)
+		for i := range events {
+			fmt.Fprintf(
+				writer,
+				`{"version":1,"time":1760000000,"dp_id":1,"dp_name":"sw1","event_id":%d,"DP_CHANGE":{"reason":"cold_start"}}`+"\n",
+				i,
+			)
+		}
+		writer.Flush()
+
+		_, _ = io.Copy(io.Discard, conn)
+	}()
+
+	sink := &blockingSink{release: make(chan struct{})}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	writeCtx, cancelWrites := context.WithCancel(context.Background())
+	defer cancelWrites()
+
+	workers := startEventWorkers(writeCtx, []MetricSink{sink}, 1, events)
+
+	exitSignal := make(chan os.Signal, 1)
+	signal.Notify(exitSignal, syscall.SIGTERM)
+	defer signal.Stop(exitSignal)
+
+	go shutdownOnSignal(exitSignal, cancel, cancelWrites)
+
+	done := make(chan error, 1)
+
+	go func() {
+		done <- readEventSocket(ctx, nil, socket, workers)
+	}()
+
+	processed := socketEventsProcessed.WithLabelValues(socket)
+	waitFor(t, "events to be read", func() bool {
+		return testutil.ToFloat64(processed) == events
+	})
+
+	if err := syscall.Kill(os.Getpid(), syscall.SIGTERM); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("reading the event socket failed: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the event socket to stop being read")
+	}
+
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the event socket connection to be closed")
+	}
+
+	// Events read before the signal are still written
+	close(sink.release)
+	workers.stop()
+
+	if writeCtx.Err() != nil {
+		t.Fatal("writes were cancelled before the shutdown timeout")
+	}
+
+	if sink.writes != events {
+		t.Fatalf("got %d writes, want %d", sink.writes, events)
+	}
+}
+
+func TestBackoffWithoutJitter(t *testing.T) {
+	saved := *noBackoffJitter
+	*noBackoffJitter = true
+	t.Cleanup(func() { *noBackoffJitter = saved })
+
+	tests := []struct {
+		name    string
+		initial time.Duration
+		maximum time.Duration
+		retries int
+		want    time.Duration
+	}{
+		{"first retry", 5 * time.Second, time.Minute, 0, 6 * time.Second},
+		{"doubles", 5 * time.Second, time.Minute, 1, 7 * time.Second},
+		{"keeps doubling", 5 * time.Second, time.Minute, 4, 21 * time.Second},
+		{"capped at max backoff", 5 * time.Second, time.Minute, 6, time.Minute},
+		{"stays capped", 5 * time.Second, time.Minute, 1000, time.Minute},
+		{"max backoff below first delay", 5 * time.Second, 5 * time.Second, 0, 5 * time.Second},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := backoff(test.initial, test.maximum, test.retries); got != test.want {
+				t.Errorf("backoff(%v, %v, %d) = %v, want %v", test.initial, test.maximum, test.retries, got, test.want)
+			}
+		})
+	}
+}
+
+func TestJitteredBackoffBounds(t *testing.T) {
+	const (
+		initial = 5 * time.Second
+		maximum = time.Hour
+		jitter  = 0.5
+	)
+
+	none := func(int64) int64 { return 0 }
+	largest := func(n int64) int64 { return n - 1 }
+
+	for retries := range 5 {
+		expo := time.Second << retries
+		lowest := initial + expo
+		highest := initial + expo + time.Duration(float64(expo)*jitter) - 1
+
+		if got := jitteredBackoff(initial, maximum, retries, jitter, none); got != lowest {
+			t.Errorf("retry %d with no random jitter: got %v, want %v", retries, got, lowest)
+		}
+
+		if got := jitteredBackoff(initial, maximum, retries, jitter, largest); got != highest {
+			t.Errorf("retry %d with the largest jitter: got %v, want %v", retries, got, highest)
+		}
+
+		for range 100 {
+			if got := jitteredBackoff(initial, maximum, retries, jitter, rand.Int63n); got < lowest || got > highest {
+				t.Fatalf("retry %d: got %v, want between %v and %v", retries, got, lowest, highest)
+			}
+		}
+	}
+
+	// The jitter doesn't take the delay past the maximum
+	if got := jitteredBackoff(initial, 6*time.Second, 0, jitter, largest); got != 6*time.Second {
+		t.Errorf("got %v past the maximum, want %v", got, 6*time.Second)
+	}
+}
+
+func TestBackoffDelayCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+
+	start := time.Now()
+	backoffDelay(ctx, time.Hour)
+
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("backoff delay took %v after the context was cancelled", elapsed)
+	}
+}
+
+func TestBackoffDelayElapses(t *testing.T) {
+	start := time.Now()
+	backoffDelay(context.Background(), 20*time.Millisecond)
+
+	if elapsed := time.Since(start); elapsed < 20*time.Millisecond {
+		t.Fatalf("backoff delay returned after %v, want at least 20ms", elapsed)
+	}
+}
+
+func TestParseFlagsEnvSplit(t *testing.T) {
+	tests := []struct {
+		name  string
+		split *string
+		value string
+		want  []string
+	}{
+		{"default separator", nil, "a=1 b=2", []string{"a=1", "b=2"}},
+		{"custom separator", proto.String(","), "a=1 x,b=2", []string{"a=1 x", "b=2"}},
+		{"empty separator", proto.String(""), "a=1 b=2,c=3", []string{"a=1 b=2,c=3"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Setenv(envVarSplit, "")
+			if test.split == nil {
+				os.Unsetenv(envVarSplit)
+			} else {
+				t.Setenv(envVarSplit, *test.split)
+			}
+			t.Setenv(strings.ToUpper(binName)+"_LABEL", test.value)
+
+			fs := ff.NewFlagSet(binName)
+			fs.StringLong("config", "", "")
+			labels := fs.StringListLong("label", "")
+
+			if err := parseFlags(fs, nil); err != nil {
+				t.Fatal(err)
+			}
+
+			if !slices.Equal(*labels, test.want) {
+				t.Errorf("got %q, want %q", *labels, test.want)
+			}
+		})
+	}
+}
+
+func TestDropReasons(t *testing.T) {
+	const (
+		l3Learn    = `{"version":1,"time":1760000000,"dp_id":1,"dp_name":"sw1","event_id":1,"L3_LEARN":{"eth_src":"0e:00:00:00:00:01","l3_src_ip":"10.0.0.1","port_no":1,"vid":100}}`
+		otherLearn = `{"version":1,"time":1760000000,"dp_id":1,"dp_name":"sw1","event_id":2,"L3_LEARN":{"eth_src":"0e:00:00:00:00:02","l3_src_ip":"10.0.0.2","port_no":1,"vid":100}}`
+	)
+
+	tests := []struct {
+		name   string
+		reason string
+		setup  func(t *testing.T)
+		sinks  []MetricSink
+		events []string
+		want   float64
+	}{
+		{
+			name:   "parse error",
+			reason: dropParseError,
+			events: []string{`{"version":`},
+			want:   1,
+		},
+		{
+			name:   "filtered",
+			reason: dropFiltered,
+			setup: func(t *testing.T) {
+				saved := allowedEventTypes
+				allowedEventTypes = map[string]bool{"DP_CHANGE": true}
+				t.Cleanup(func() { allowedEventTypes = saved })
+			},
+			events: []string{l3Learn},
+			want:   1,
+		},
+		{
+			name:   "sampled",
+			reason: dropSampled,
+			setup: func(t *testing.T) {
+				saved := eventSampleRates
+				eventSampleRates = map[string]float64{"L3_LEARN": 0}
+				t.Cleanup(func() { eventSampleRates = saved })
+			},
+			events: []string{l3Learn},
+			want:   1,
+		},
+		{
+			name:   "unknown type",
+			reason: dropUnknownType,
+			events: []string{`{"version":1,"time":1760000000,"dp_id":1,"dp_name":"sw1","event_id":1}`},
+			want:   1,
+		},
+		{
+			name:   "invalid L3 learn IP",
+			reason: dropMalformed,
+			events: []string{`{"version":1,"time":1760000000,"dp_id":1,"dp_name":"sw1","event_id":1,"L3_LEARN":{"eth_src":"0e:00:00:00:00:01","l3_src_ip":"10.0.0.300","port_no":1,"vid":100}}`},
+			want:   1,
+		},
+		{
+			name:   "invalid ARP neighbor IP",
+			reason: dropMalformed,
+			events: []string{`{"version":1,"time":1760000000,"dp_id":1,"dp_name":"sw1","event_id":1,"L2_LEARN":{"port_no":1,"previous_port_no":0,"vid":100,"eth_src":"0e:00:00:00:00:01","eth_dst":"ff:ff:ff:ff:ff:ff","eth_type":2054,"l3_src_ip":"10.0.0.300","l3_dst_ip":"10.0.0.2"}}`},
+			want:   1,
+		},
+		{
+			name:   "cardinality limit",
+			reason: dropCardinalityLimit,
+			setup: func(t *testing.T) {
+				saved := *maxL3Hosts
+				*maxL3Hosts = 1
+				t.Cleanup(func() { *maxL3Hosts = saved })
+
+				l3Hosts = newHostTracker(*l3HostTTL, *maxL3Hosts)
+			},
+			events: []string{l3Learn, otherLearn, l3Learn},
+			want:   1,
+		},
+		{
+			name:   "deduplicated",
+			reason: dropDeduplicated,
+			setup: func(t *testing.T) {
+				saved := dedup
+				dedup = newDedupTracker(time.Hour, 100)
+				t.Cleanup(func() { dedup = saved })
+			},
+			events: []string{l3Learn, l3Learn},
+			// The faucet_l3_info series of the second event
+			want: 1,
+		},
+		{
+			name:   "too old",
+			reason: dropTooOld,
+			setup: func(t *testing.T) {
+				saved := *maxSampleAge
+				*maxSampleAge = time.Hour
+				t.Cleanup(func() { *maxSampleAge = saved })
+			},
+			sinks:  []MetricSink{newRemoteWriteSink("old", &url.URL{}, "", nil, nil, nil)},
+			events: []string{l3Learn},
+			// faucet_l3_info, faucet_distinct_l3_hosts and faucet_agent_learn_rate
+			want: 3,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			resetMetricState(t)
+
+			if test.setup != nil {
+				test.setup(t)
+			}
+
+			dropped := eventsDropped.WithLabelValues(test.reason)
+			before := testutil.ToFloat64(dropped)
+
+			for _, event := range test.events {
+				handleEvent(context.Background(), test.sinks, event)
+			}
+
+			if got := testutil.ToFloat64(dropped) - before; got != test.want {
+				t.Errorf("got %v dropped with reason %s, want %v", got, test.reason, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,772 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math"
+	"net"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/prometheus/model/value"
+	"google.golang.org/protobuf/proto"
+)
+
+// Name of the event's datapath, falling back to its prefixed dp_id when the
+// event has no dp_name
+func dpName(event FaucetEvent) string {
+	if event.DpName == "" && *dpNameFallback != "" {
+		return *dpNameFallback + strconv.Itoa(event.DpID)
+	}
+
+	return event.DpName
+}
+
+// Datapath name as used for the dp_name label, after the fallback and with
+// any --dp-name-strip-prefix match removed, along with the removed prefix
+func dpNameLabel(event FaucetEvent) (string, string) {
+	name := dpName(event)
+
+	if dpNameStripRegexp != nil {
+		if loc := dpNameStripRegexp.FindStringIndex(name); loc != nil {
+			return name[loc[1]:], name[:loc[1]]
+		}
+	}
+
+	return name, ""
+}
+
+// Number of events that could have been logged at debug level
+var eventLogCount atomic.Uint64
+
+// Whether to log the current event at debug level, with
+// --debug-log-sample-rate only every Nth event is logged
+func sampleEventLog() bool {
+	if !slog.Default().Enabled(context.Background(), slog.LevelDebug) {
+		return false
+	}
+
+	return (eventLogCount.Add(1)-1)%uint64(*debugSampleRate) == 0
+}
+
+// Build the labels common to every metric derived from an event
+func eventLabels(event FaucetEvent) []*dto.LabelPair {
+	name, prefix := dpNameLabel(event)
+
+	labels := []*dto.LabelPair{
+		{
+			Name:  proto.String("instance"),
+			Value: proto.String(hostname),
+		},
+		{
+			Name:  proto.String("dp_id"),
+			Value: proto.String(strconv.Itoa(event.DpID)),
+		},
+		{
+			Name:  proto.String("dp_name"),
+			Value: proto.String(name),
+		},
+	}
+
+	if *dpNamePrefix != "" && prefix != "" {
+		labels = append(labels, &dto.LabelPair{
+			Name:  proto.String(*dpNamePrefix),
+			Value: proto.String(prefix),
+		})
+	}
+
+	if *versionLabel {
+		labels = append(labels, &dto.LabelPair{
+			Name:  proto.String("faucet_event_version"),
+			Value: proto.String(strconv.Itoa(event.Version)),
+		})
+	}
+
+	switch *eventIDMode {
+	case "label":
+		labels = append(labels, &dto.LabelPair{
+			Name:  proto.String("event_id"),
+			Value: proto.String(strconv.Itoa(event.EventID)),
+		})
+	case "exemplar":
+		labels = append(labels, &dto.LabelPair{
+			Name:  proto.String(exemplarLabelPrefix + "event_id"),
+			Value: proto.String(strconv.Itoa(event.EventID)),
+		})
+	}
+
+	return labels
+}
+
+// Prefix of the metric names built from events, replaced by --metrics-prefix
+const defaultMetricsPrefix = "faucet_"
+
+// Metrics describing learned hosts, which go stale once a host is no longer
+// seen, without the metrics prefix
+var learnMetrics = map[string]bool{
+	"arp_neighbor_info": true,
+	"l2_info":           true,
+	"l3_info":           true,
+}
+
+func isLearnMetric(name string) bool {
+	name, ok := strings.CutPrefix(name, *metricsPrefix)
+
+	return ok && learnMetrics[name]
+}
+
+// Replace the default prefix of metric names built from events with
+// --metrics-prefix
+func prefixMetrics(metrics map[string]*dto.MetricFamily) {
+	if *metricsPrefix == defaultMetricsPrefix {
+		return
+	}
+
+	for name, family := range metrics {
+		rest, ok := strings.CutPrefix(name, defaultMetricsPrefix)
+		if !ok {
+			continue
+		}
+
+		delete(metrics, name)
+
+		name = *metricsPrefix + rest
+		family.Name = proto.String(name)
+		metrics[name] = family
+	}
+}
+
+// Build the metrics for an event, named and sanitized ready for the sinks.
+// This doesn't write anything, but does update the learn counters and the
+// distinct L3 host tracker.
+func eventToMetricFamilies(event FaucetEvent) map[string]*dto.MetricFamily {
+	metrics := map[string]*dto.MetricFamily{}
+
+	// A learn event that is dropped doesn't count as a learn
+	if event.L3Learn != nil && l3LearnMetrics(metrics, event) {
+		learnRateMetrics(metrics, event, event.L3Learn.Vid)
+	}
+
+	if event.L2Learn != nil && l2LearnMetrics(metrics, event) {
+		learnRateMetrics(metrics, event, event.L2Learn.Vid)
+		macMoveMetrics(metrics, event)
+		arpNeighborMetrics(metrics, event)
+	}
+
+	if event.PortChange != nil {
+		portChangeMetrics(metrics, event)
+	}
+
+	if event.ConfigChange != nil {
+		configChangeMetrics(metrics, event)
+	}
+
+	if event.DpChange != nil {
+		dpChangeMetrics(metrics, event)
+	}
+
+	prefixMetrics(metrics)
+	sanitizeMetrics(metrics)
+
+	return metrics
+}
+
+// Convert an event time in --timestamp-unit to seconds, since some faucet
+// versions send milliseconds
+func eventTimeSeconds(t float64) float64 {
+	switch *timestampUnit {
+	case "milliseconds":
+		return t / 1000
+	case "auto":
+		if t > maxEventTimeSeconds {
+			return t / 1000
+		}
+	}
+
+	return t
+}
+
+// Timestamp of an event in milliseconds
+func eventTimestamp(event FaucetEvent) int64 {
+	return int64(event.Time * 1000)
+}
+
+// Parse comma separated lists of label names, returning nil if there are none
+func parseLabelList(lists []string) map[string]bool {
+	var names map[string]bool
+
+	for _, list := range lists {
+		for _, name := range strings.Split(list, ",") {
+			name = strings.TrimSpace(name)
+			if name == "" {
+				continue
+			}
+
+			if names == nil {
+				names = map[string]bool{}
+			}
+			names[name] = true
+		}
+	}
+
+	return names
+}
+
+// Remove the labels excluded by --drop-labels and --keep-labels. Series that
+// only differed by a removed label become one series, counters then count
+// the events of all of them and gauges take the latest value.
+func filterLabels(labels []*dto.LabelPair) []*dto.LabelPair {
+	if droppedLabels == nil && keptLabels == nil {
+		return labels
+	}
+
+	filtered := make([]*dto.LabelPair, 0, len(labels))
+
+	for _, label := range labels {
+		name := label.GetName()
+
+		// Exemplar labels don't add to the series cardinality, and instance
+		// tells the agents apart
+		if name != "instance" && !strings.HasPrefix(name, exemplarLabelPrefix) {
+			if droppedLabels[name] || (keptLabels != nil && !keptLabels[name]) {
+				continue
+			}
+		}
+
+		filtered = append(filtered, label)
+	}
+
+	return filtered
+}
+
+// Copy of labels without the exemplar labels, for series that are kept
+// around after the event they came from
+func stripExemplarLabels(labels []*dto.LabelPair) []*dto.LabelPair {
+	return slices.DeleteFunc(slices.Clone(labels), func(label *dto.LabelPair) bool {
+		return strings.HasPrefix(label.GetName(), exemplarLabelPrefix)
+	})
+}
+
+// Build a metric family holding a single gauge sample
+func gaugeFamily(name string, labels []*dto.LabelPair, value float64, timestampMs int64) *dto.MetricFamily {
+	return &dto.MetricFamily{
+		Name: proto.String(name),
+		Type: dto.MetricType_GAUGE.Enum(),
+		Metric: []*dto.Metric{
+			{
+				Label: filterLabels(labels),
+				Gauge: &dto.Gauge{
+					Value: proto.Float64(value),
+				},
+				TimestampMs: proto.Int64(timestampMs),
+			},
+		},
+	}
+}
+
+// Build a metric family holding a single counter sample
+func counterFamily(name string, labels []*dto.LabelPair, value float64, timestampMs int64) *dto.MetricFamily {
+	return &dto.MetricFamily{
+		Name: proto.String(name),
+		Type: dto.MetricType_COUNTER.Enum(),
+		Metric: []*dto.Metric{
+			{
+				Label: counterLabels(labels),
+				Counter: &dto.Counter{
+					Value: proto.Float64(value),
+				},
+				TimestampMs: proto.Int64(timestampMs),
+			},
+		},
+	}
+}
+
+// Canonicalize a MAC address to lowercase xx:xx:xx:xx:xx:xx form
+func normalizeMAC(mac string) (string, error) {
+	hw, err := net.ParseMAC(mac)
+	if err != nil {
+		return "", err
+	}
+
+	if len(hw) != 6 {
+		return "", fmt.Errorf("not a 48-bit MAC address: %s", mac)
+	}
+
+	return hw.String(), nil
+}
+
+// Add metrics for an L3_LEARN event, returning false if the event was dropped
+// as malformed or for a host over --max-l3-hosts
+func l3LearnMetrics(metrics map[string]*dto.MetricFamily, event FaucetEvent) bool {
+	if sampleEventLog() {
+		slog.Debug(
+			"Received L3 learn event",
+			"timestamp",
+			time.UnixMilli(eventTimestamp(event)),
+			"dp",
+			event.DpName,
+			"event",
+			event.L3Learn,
+		)
+	}
+
+	mac, err := normalizeMAC(event.L3Learn.EthSrc)
+	if err != nil {
+		slog.Error(
+			"Dropping L3 learn event with invalid MAC address",
+			"mac",
+			event.L3Learn.EthSrc,
+			"error",
+			err.Error(),
+		)
+		eventsDropped.WithLabelValues(dropMalformed).Inc()
+
+		return false
+	}
+
+	addr, err := netip.ParseAddr(event.L3Learn.L3SrcIP)
+	if err != nil {
+		slog.Error(
+			"Dropping L3 learn event with invalid IP address",
+			"ip",
+			event.L3Learn.L3SrcIP,
+			"error",
+			err.Error(),
+		)
+		eventsDropped.WithLabelValues(dropMalformed).Inc()
+
+		return false
+	}
+
+	// Normalized, so that each way of writing an address is the same series
+	addr = addr.Unmap()
+	ip := addr.String()
+
+	ipVersion := "6"
+	if addr.Is4() {
+		ipVersion = "4"
+	}
+
+	distinctHosts, ok := l3Hosts.observe(event.DpID, ip, time.Now())
+	if !ok {
+		slog.Warn(
+			"Dropping L3 learn event for a new host, datapath has the maximum number of L3 hosts",
+			"dp",
+			event.DpName,
+			"ip",
+			ip,
+			"max_l3_hosts",
+			*maxL3Hosts,
+		)
+		eventsDropped.WithLabelValues(dropCardinalityLimit).Inc()
+
+		return false
+	}
+
+	labels := append(eventLabels(event), []*dto.LabelPair{
+		{
+			Name:  proto.String("mac"),
+			Value: proto.String(mac),
+		},
+		{
+			Name:  proto.String("ip"),
+			Value: proto.String(ip),
+		},
+		{
+			Name:  proto.String("ip_version"),
+			Value: proto.String(ipVersion),
+		},
+	}...)
+	labels = append(labels, vidLabels(event.L3Learn.Vid)...)
+	labels = append(labels, portLabels("port", dpName(event), event.L3Learn.PortNo)...)
+
+	// Info series, the labels carry the information and the value is always 1
+	metrics["faucet_l3_info"] = gaugeFamily(
+		"faucet_l3_info",
+		labels,
+		1,
+		eventTimestamp(event),
+	)
+
+	metrics["faucet_distinct_l3_hosts"] = gaugeFamily(
+		"faucet_distinct_l3_hosts",
+		eventLabels(event),
+		float64(distinctHosts),
+		eventTimestamp(event),
+	)
+
+	return true
+}
+
+// Count learn events per datapath and VLAN, leaving out the other event
+// labels so that the series are stable enough to rate over long windows
+func learnRateMetrics(metrics map[string]*dto.MetricFamily, event FaucetEvent, vid int) {
+	var labels []*dto.LabelPair
+	for _, label := range eventLabels(event) {
+		if name := label.GetName(); name == "instance" || name == "dp_name" {
+			labels = append(labels, label)
+		}
+	}
+
+	labels = append(labels, &dto.LabelPair{
+		Name:  proto.String("vid"),
+		Value: proto.String(strconv.Itoa(vid)),
+	})
+
+	metrics["faucet_agent_learn_rate"] = counterFamily(
+		"faucet_agent_learn_rate",
+		labels,
+		eventCounters.inc("faucet_agent_learn_rate", labels),
+		eventTimestamp(event),
+	)
+}
+
+// Add metrics for an L2_LEARN event, returning false if the event was dropped
+// as malformed
+func l2LearnMetrics(metrics map[string]*dto.MetricFamily, event FaucetEvent) bool {
+	if sampleEventLog() {
+		slog.Debug(
+			"Received L2 learn event",
+			"timestamp",
+			time.UnixMilli(eventTimestamp(event)),
+			"dp",
+			event.DpName,
+			"event",
+			event.L2Learn,
+		)
+	}
+
+	mac, err := normalizeMAC(event.L2Learn.EthSrc)
+	if err != nil {
+		slog.Error(
+			"Dropping L2 learn event with invalid MAC address",
+			"mac",
+			event.L2Learn.EthSrc,
+			"error",
+			err.Error(),
+		)
+		eventsDropped.WithLabelValues(dropMalformed).Inc()
+
+		return false
+	}
+
+	labels := append(eventLabels(event), []*dto.LabelPair{
+		{
+			Name:  proto.String("mac"),
+			Value: proto.String(mac),
+		},
+		{
+			Name:  proto.String("eth_type"),
+			Value: proto.String(strconv.Itoa(event.L2Learn.EthType)),
+		},
+	}...)
+	labels = append(labels, vidLabels(event.L2Learn.Vid)...)
+	labels = append(labels, portLabels("port", dpName(event), event.L2Learn.PortNo)...)
+
+	if *resolveEthTypes {
+		labels = append(labels, &dto.LabelPair{
+			Name:  proto.String("eth_type_name"),
+			Value: proto.String(etherTypeName(event.L2Learn.EthType)),
+		})
+	}
+
+	// Info series, the labels carry the information and the value is always 1
+	metrics["faucet_l2_info"] = gaugeFamily(
+		"faucet_l2_info",
+		labels,
+		1,
+		eventTimestamp(event),
+	)
+
+	return true
+}
+
+// Add a neighbor for an L2 learn of an ARP packet, which ties the sender's
+// MAC address to its IP address
+func arpNeighborMetrics(metrics map[string]*dto.MetricFamily, event FaucetEvent) {
+	if event.L2Learn.EthType != etherTypeARP || event.L2Learn.L3SrcIP == "" {
+		return
+	}
+
+	// An invalid MAC address is already logged by the L2 learn metrics
+	mac, err := normalizeMAC(event.L2Learn.EthSrc)
+	if err != nil {
+		return
+	}
+
+	addr, err := netip.ParseAddr(event.L2Learn.L3SrcIP)
+	if err != nil {
+		slog.Error(
+			"Ignoring ARP neighbor with invalid IP address",
+			"ip",
+			event.L2Learn.L3SrcIP,
+			"error",
+			err.Error(),
+		)
+		eventsDropped.WithLabelValues(dropMalformed).Inc()
+
+		return
+	}
+
+	labels := append(eventLabels(event), []*dto.LabelPair{
+		{
+			Name:  proto.String("mac"),
+			Value: proto.String(mac),
+		},
+		{
+			Name:  proto.String("ip"),
+			Value: proto.String(addr.Unmap().String()),
+		},
+	}...)
+	labels = append(labels, vidLabels(event.L2Learn.Vid)...)
+	labels = append(labels, portLabels("port", dpName(event), event.L2Learn.PortNo)...)
+
+	// Info series, the labels carry the information and the value is always 1
+	metrics["faucet_arp_neighbor_info"] = gaugeFamily(
+		"faucet_arp_neighbor_info",
+		labels,
+		1,
+		eventTimestamp(event),
+	)
+}
+
+// Port an L2 learn event's MAC address was previously learned on. JSON
+// numbers decode as float64, and faucet sends null for newly learned MACs.
+func previousPortNo(learn *L2Learn) (int, bool) {
+	port, ok := learn.PreviousPortNo.(float64)
+	if !ok {
+		return 0, false
+	}
+
+	return int(port), true
+}
+
+// Count MAC addresses moving between ports, which flags loops or relocated
+// devices
+func macMoveMetrics(metrics map[string]*dto.MetricFamily, event FaucetEvent) {
+	previous, ok := previousPortNo(event.L2Learn)
+	if !ok || previous == event.L2Learn.PortNo {
+		return
+	}
+
+	mac, err := normalizeMAC(event.L2Learn.EthSrc)
+	if err != nil {
+		slog.Error(
+			"Ignoring MAC move with invalid MAC address",
+			"mac",
+			event.L2Learn.EthSrc,
+			"error",
+			err.Error(),
+		)
+
+		return
+	}
+
+	slog.Debug(
+		"MAC address moved port",
+		"dp",
+		event.DpName,
+		"mac",
+		mac,
+		"from",
+		previous,
+		"to",
+		event.L2Learn.PortNo,
+	)
+
+	labels := append(eventLabels(event), &dto.LabelPair{
+		Name:  proto.String("eth_src"),
+		Value: proto.String(mac),
+	})
+	labels = append(labels, vidLabels(event.L2Learn.Vid)...)
+
+	metrics["faucet_mac_move_total"] = counterFamily(
+		"faucet_mac_move_total",
+		labels,
+		eventCounters.inc("faucet_mac_move_total", labels),
+		eventTimestamp(event),
+	)
+}
+
+// Add metrics for a PORT_CHANGE event
+func portChangeMetrics(metrics map[string]*dto.MetricFamily, event FaucetEvent) {
+	if sampleEventLog() {
+		slog.Debug(
+			"Received port change event",
+			"timestamp",
+			time.UnixMilli(eventTimestamp(event)),
+			"dp",
+			event.DpName,
+			"event",
+			event.PortChange,
+		)
+	}
+
+	labels := append(eventLabels(event), &dto.LabelPair{
+		Name:  proto.String("reason"),
+		Value: proto.String(event.PortChange.Reason),
+	})
+	labels = append(labels, portLabels("port_no", dpName(event), event.PortChange.PortNo)...)
+
+	status := 0.0
+	if event.PortChange.Status {
+		status = 1
+	}
+
+	metrics["faucet_port_status"] = gaugeFamily(
+		"faucet_port_status",
+		labels,
+		status,
+		eventTimestamp(event),
+	)
+
+	metrics["faucet_port_state"] = gaugeFamily(
+		"faucet_port_state",
+		labels,
+		float64(event.PortChange.State),
+		eventTimestamp(event),
+	)
+
+	// Written on every port change, so that the first flap shows as an
+	// increase
+	flaps := 0.0
+	if portStatuses.changed(event.DpID, event.PortChange.PortNo, event.PortChange.Status) {
+		flaps = 1
+	}
+
+	flapLabels := append(eventLabels(event), portLabels("port_no", dpName(event), event.PortChange.PortNo)...)
+
+	metrics["faucet_port_flaps_total"] = counterFamily(
+		"faucet_port_flaps_total",
+		flapLabels,
+		eventCounters.add("faucet_port_flaps_total", flapLabels, flaps),
+		eventTimestamp(event),
+	)
+}
+
+// Add metrics for a CONFIG_CHANGE event
+func configChangeMetrics(metrics map[string]*dto.MetricFamily, event FaucetEvent) {
+	if sampleEventLog() {
+		slog.Debug(
+			"Received config change event",
+			"timestamp",
+			time.UnixMilli(eventTimestamp(event)),
+			"dp",
+			event.DpName,
+			"event",
+			event.ConfigChange,
+		)
+	}
+
+	if event.ConfigChange.Success != nil {
+		success := 0.0
+		if *event.ConfigChange.Success {
+			success = 1
+		}
+
+		metrics["faucet_config_reload_success"] = gaugeFamily(
+			"faucet_config_reload_success",
+			eventLabels(event),
+			success,
+			eventTimestamp(event),
+		)
+	}
+
+	restartType := ""
+	if event.ConfigChange.RestartType != nil {
+		restartType = *event.ConfigChange.RestartType
+	}
+
+	reloadLabels := append(eventLabels(event), &dto.LabelPair{
+		Name:  proto.String("restart_type"),
+		Value: proto.String(restartType),
+	})
+
+	metrics["faucet_config_reload_total"] = counterFamily(
+		"faucet_config_reload_total",
+		reloadLabels,
+		eventCounters.inc("faucet_config_reload_total", reloadLabels),
+		eventTimestamp(event),
+	)
+
+	if info := event.ConfigChange.ConfigHashInfo; info != nil && info.Hashes != "" {
+		configHashMetrics(metrics, event)
+	}
+
+	if info := event.ConfigChange.ConfigHashInfo; info != nil && info.Error != "" {
+		metrics["faucet_config_hash_error"] = gaugeFamily(
+			"faucet_config_hash_error",
+			append(eventLabels(event), &dto.LabelPair{
+				Name:  proto.String("error"),
+				Value: proto.String(info.Error),
+			}),
+			1,
+			eventTimestamp(event),
+		)
+	}
+}
+
+// Add metrics for a DP_CHANGE event
+func dpChangeMetrics(metrics map[string]*dto.MetricFamily, event FaucetEvent) {
+	if sampleEventLog() {
+		slog.Debug(
+			"Received datapath change event",
+			"timestamp",
+			time.UnixMilli(eventTimestamp(event)),
+			"dp",
+			event.DpName,
+			"event",
+			event.DpChange,
+		)
+	}
+
+	metrics["faucet_dp_status_info"] = gaugeFamily(
+		"faucet_dp_status_info",
+		append(eventLabels(event), &dto.LabelPair{
+			Name:  proto.String("reason"),
+			Value: proto.String(event.DpChange.Reason),
+		}),
+		1,
+		eventTimestamp(event),
+	)
+}
+
+// Add the config files and hashes a datapath is running with. Each datapath
+// has a single series, so when the hashes change the previous series is
+// ended with a staleness marker.
+func configHashMetrics(metrics map[string]*dto.MetricFamily, event FaucetEvent) {
+	info := event.ConfigChange.ConfigHashInfo
+
+	labels := append(eventLabels(event), []*dto.LabelPair{
+		{
+			Name:  proto.String("config_files"),
+			Value: proto.String(info.ConfigFiles),
+		},
+		{
+			Name:  proto.String("hashes"),
+			Value: proto.String(info.Hashes),
+		},
+	}...)
+
+	family := gaugeFamily("faucet_config_hash_info", labels, 1, eventTimestamp(event))
+
+	// Without the event ID exemplar, which would make every event look like
+	// a new series, and doesn't belong on the staleness marker
+	if previous := configHashes.swap(event.DpID, stripExemplarLabels(labels)); previous != nil {
+		stale := gaugeFamily(
+			"faucet_config_hash_info",
+			previous,
+			math.Float64frombits(value.StaleNaN),
+			eventTimestamp(event),
+		)
+		family.Metric = append(stale.Metric, family.Metric...)
+	}
+
+	metrics["faucet_config_hash_info"] = family
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"google.golang.org/protobuf/proto"
+)
+
+var update = flag.Bool("update", false, "Update the golden files in testdata")
+
+// Start from empty counters and trackers, so that a test doesn't depend on
+// events handled by the tests before it
+func resetMetricState(t *testing.T) {
+	t.Helper()
+
+	savedCounters, savedPorts, savedHashes := eventCounters, portStatuses, configHashes
+	savedHosts, savedHostname := l3Hosts, hostname
+
+	t.Cleanup(func() {
+		eventCounters, portStatuses, configHashes = savedCounters, savedPorts, savedHashes
+		l3Hosts, hostname = savedHosts, savedHostname
+	})
+
+	eventCounters = newCounterStore()
+	portStatuses = newPortStatusTracker()
+	configHashes = newConfigHashTracker()
+	l3Hosts = newHostTracker(*l3HostTTL, *maxL3Hosts)
+	hostname = "test"
+}
+
+// Write the metric families in text format, sorted by name
+func metricFamiliesText(t *testing.T, metrics map[string]*dto.MetricFamily) string {
+	t.Helper()
+
+	var text bytes.Buffer
+
+	for _, name := range slices.Sorted(maps.Keys(metrics)) {
+		if _, err := expfmt.MetricFamilyToText(&text, metrics[name]); err != nil {
+			t.Fatalf("writing %s: %v", name, err)
+		}
+	}
+
+	return text.String()
+}
+
+// Each testdata/*.json file holds a list of events, which are converted in
+// order. The families built for every event are compared with the matching
+// .golden file, which is rewritten instead with -update.
+func TestEventToMetricFamilies(t *testing.T) {
+	fixtures, err := filepath.Glob("testdata/*.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, fixture := range fixtures {
+		name := strings.TrimSuffix(filepath.Base(fixture), ".json")
+
+		t.Run(name, func(t *testing.T) {
+			resetMetricState(t)
+
+			data, err := os.ReadFile(fixture)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var events []FaucetEvent
+			if err := json.Unmarshal(data, &events); err != nil {
+				t.Fatal(err)
+			}
+
+			var got strings.Builder
+			for i, event := range events {
+				fmt.Fprintf(&got, "# event %d %s\n", i, event.Type())
+				got.WriteString(metricFamiliesText(t, eventToMetricFamilies(event)))
+			}
+
+			golden := strings.TrimSuffix(fixture, ".json") + ".golden"
+
+			if *update {
+				if err := os.WriteFile(golden, []byte(got.String()), 0o644); err != nil {
+					t.Fatal(err)
+				}
+
+				return
+			}
+
+			want, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got.String() != string(want) {
+				t.Errorf("metrics for %s differ from %s\ngot:\n%s\nwant:\n%s", fixture, golden, got.String(), want)
+			}
+		})
+	}
+}
+
+func TestEventTimeSeconds(t *testing.T) {
+	tests := []struct {
+		unit string
+		time float64
+		want float64
+	}{
+		{"seconds", 1760000000.5, 1760000000.5},
+		{"seconds", 1760000000500, 1760000000500},
+		{"milliseconds", 1760000000500, 1760000000.5},
+		{"milliseconds", 1760000000, 1760000},
+		{"auto", 1760000000.5, 1760000000.5},
+		{"auto", 1760000000500, 1760000000.5},
+		{"auto", maxEventTimeSeconds, maxEventTimeSeconds},
+		{"auto", maxEventTimeSeconds + 1, (maxEventTimeSeconds + 1) / 1000},
+		{"auto", 0, 0},
+	}
+
+	saved := *timestampUnit
+	t.Cleanup(func() { *timestampUnit = saved })
+
+	for _, test := range tests {
+		t.Run(fmt.Sprintf("%s %.1f", test.unit, test.time), func(t *testing.T) {
+			*timestampUnit = test.unit
+
+			if got := eventTimeSeconds(test.time); got != test.want {
+				t.Errorf("eventTimeSeconds(%.1f) = %.3f, want %.3f", test.time, got, test.want)
+			}
+		})
+	}
+}
+
+func TestEventStateExpiry(t *testing.T) {
+	const ttl = time.Hour
+
+	resetMetricState(t)
+
+	labels := []*dto.LabelPair{{Name: proto.String("dp_name"), Value: proto.String("sw1")}}
+	changed := []*dto.LabelPair{{Name: proto.String("dp_name"), Value: proto.String("sw2")}}
+
+	eventCounters.inc("faucet_config_reload_total", labels)
+	portStatuses.changed(1, 1, true)
+	configHashes.swap(1, labels)
+
+	// Kept while they are within the ttl
+	if got := eventCounters.expire(time.Now().Add(ttl/2), ttl); got != 0 {
+		t.Errorf("expired %d counters within the ttl, want 0", got)
+	}
+
+	if got := portStatuses.expire(time.Now().Add(ttl/2), ttl); got != 0 {
+		t.Errorf("expired %d port statuses within the ttl, want 0", got)
+	}
+
+	if got := configHashes.expire(time.Now().Add(ttl/2), ttl); got != 0 {
+		t.Errorf("expired %d config hashes within the ttl, want 0", got)
+	}
+
+	if got := eventCounters.inc("faucet_config_reload_total", labels); got != 2 {
+		t.Errorf("got counter value %v before expiry, want 2", got)
+	}
+
+	// Forgotten once they are past it
+	if got := eventCounters.expire(time.Now().Add(2*ttl), ttl); got != 1 {
+		t.Errorf("expired %d counters past the ttl, want 1", got)
+	}
+
+	if got := portStatuses.expire(time.Now().Add(2*ttl), ttl); got != 1 {
+		t.Errorf("expired %d port statuses past the ttl, want 1", got)
+	}
+
+	if got := configHashes.expire(time.Now().Add(2*ttl), ttl); got != 1 {
+		t.Errorf("expired %d config hashes past the ttl, want 1", got)
+	}
+
+	if got := eventCounters.inc("faucet_config_reload_total", labels); got != 1 {
+		t.Errorf("got counter value %v after expiry, want it to start again from 1", got)
+	}
+
+	if portStatuses.changed(1, 1, false) {
+		t.Error("first status of a forgotten port counted as a change")
+	}
+
+	if previous := configHashes.swap(1, changed); previous != nil {
+		t.Errorf("got previous config hash labels %v for a forgotten datapath, want none", previous)
+	}
+}
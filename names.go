@@ -0,0 +1,68 @@
+package main
+
+import (
+	"strings"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/model"
+	"google.golang.org/protobuf/proto"
+)
+
+// Validation scheme for metric and label names, set by --name-validation
+func nameValidationScheme() model.ValidationScheme {
+	if *nameValidation == "utf8" {
+		return model.UTF8Validation
+	}
+
+	return model.LegacyValidation
+}
+
+// Make metric and label names valid under the name validation scheme, and
+// label values valid UTF-8, since receivers reject the whole request
+// otherwise. Legacy names have invalid characters replaced with underscores,
+// UTF-8 names only have invalid UTF-8 replaced.
+func sanitizeMetrics(metrics map[string]*dto.MetricFamily) {
+	scheme := nameValidationScheme()
+
+	for name, family := range metrics {
+		if !scheme.IsValidMetricName(name) {
+			delete(metrics, name)
+
+			name = sanitizeName(name, true)
+			family.Name = proto.String(name)
+			metrics[name] = family
+		}
+
+		for _, metric := range family.GetMetric() {
+			for _, label := range metric.GetLabel() {
+				if !scheme.IsValidLabelName(label.GetName()) {
+					label.Name = proto.String(sanitizeName(label.GetName(), false))
+				}
+
+				label.Value = proto.String(strings.ToValidUTF8(label.GetValue(), "\uFFFD"))
+			}
+		}
+	}
+}
+
+func sanitizeName(name string, metric bool) string {
+	if *nameValidation == "utf8" {
+		return strings.ToValidUTF8(name, "_")
+	}
+
+	var sanitized strings.Builder
+
+	for i, r := range name {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r == '_':
+		case r >= '0' && r <= '9' && i > 0:
+		case r == ':' && metric:
+		default:
+			r = '_'
+		}
+
+		sanitized.WriteRune(r)
+	}
+
+	return sanitized.String()
+}
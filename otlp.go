@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"net/http"
+	"net/url"
+	"slices"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/version"
+	"github.com/prometheus/prometheus/model/value"
+	"github.com/prometheus/prometheus/prompb"
+	"go.opentelemetry.io/collector/pdata/pcommon"
+	"go.opentelemetry.io/collector/pdata/pmetric"
+	"go.opentelemetry.io/collector/pdata/pmetric/pmetricotlp"
+)
+
+// Pushes metrics to an OpenTelemetry collector over OTLP/HTTP
+type otlpSink struct {
+	name     string
+	endpoint *url.URL
+	client   *http.Client
+}
+
+func newOTLPSink(endpoint *url.URL) *otlpSink {
+	return &otlpSink{
+		name:     "otlp:" + endpoint.Host,
+		endpoint: endpoint,
+		client:   &http.Client{},
+	}
+}
+
+func (s *otlpSink) Name() string {
+	return s.name
+}
+
+func (s *otlpSink) Write(ctx context.Context, metrics map[string]*dto.MetricFamily) error {
+	writeRequest, err := buildWriteRequest(metrics, *externalLabels.Load())
+	if err != nil {
+		marshalErrors.WithLabelValues(s.name).Inc()
+
+		slog.Error(
+			"Unable to format OTLP request",
+			"sink",
+			s.name,
+			"metrics",
+			slices.Sorted(maps.Keys(metrics)),
+			"error",
+			err.Error(),
+		)
+
+		return err
+	}
+
+	if len(writeRequest.Timeseries) == 0 {
+		return nil
+	}
+
+	if *dryRun {
+		logWriteRequest(s.name, writeRequest)
+
+		return nil
+	}
+
+	body, err := pmetricotlp.NewExportRequestFromMetrics(toOTLPMetrics(writeRequest)).MarshalProto()
+	if err != nil {
+		marshalErrors.WithLabelValues(s.name).Inc()
+
+		slog.Error(
+			"Unable to marshal OTLP request",
+			"sink",
+			s.name,
+			"metrics",
+			slices.Sorted(maps.Keys(metrics)),
+			"error",
+			err.Error(),
+		)
+
+		return err
+	}
+
+	if err := s.export(ctx, body); err != nil {
+		lastRemoteWriteFailure.Store(time.Now().UnixNano())
+
+		slog.Error(
+			"Unable to send OTLP request",
+			"sink",
+			s.name,
+			"metrics",
+			slices.Sorted(maps.Keys(metrics)),
+			"error",
+			err.Error(),
+		)
+
+		return err
+	}
+
+	lastRemoteWriteSuccess.Store(time.Now().UnixNano())
+
+	return nil
+}
+
+// Send an encoded export request, warning about any data points the
+// collector only partially accepted
+func (s *otlpSink) export(ctx context.Context, body []byte) error {
+	ctx, cancel := context.WithTimeout(ctx, *promTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.endpoint.String(), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-protobuf")
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("server returned HTTP status %s: %s", resp.Status, bytes.TrimSpace(respBody))
+	}
+
+	// Collectors may send an empty or non-protobuf body on success
+	exportResponse := pmetricotlp.NewExportResponse()
+	if err := exportResponse.UnmarshalProto(respBody); err != nil {
+		return nil
+	}
+
+	if partial := exportResponse.PartialSuccess(); partial.RejectedDataPoints() > 0 {
+		slog.Warn(
+			"Collector rejected some data points",
+			"sink",
+			s.name,
+			"rejected",
+			partial.RejectedDataPoints(),
+			"error",
+			partial.ErrorMessage(),
+		)
+	}
+
+	return nil
+}
+
+// Convert a remote write request to OTLP metrics. Counters become cumulative
+// monotonic sums and everything else a gauge, with one metric per name.
+func toOTLPMetrics(writeRequest *prompb.WriteRequest) pmetric.Metrics {
+	metadata := make(map[string]prompb.MetricMetadata, len(writeRequest.Metadata))
+	for _, m := range writeRequest.Metadata {
+		metadata[m.MetricFamilyName] = m
+	}
+
+	md := pmetric.NewMetrics()
+
+	rm := md.ResourceMetrics().AppendEmpty()
+	rm.Resource().Attributes().PutStr("service.name", binName)
+	rm.Resource().Attributes().PutStr("service.version", version.Version)
+
+	sm := rm.ScopeMetrics().AppendEmpty()
+	sm.Scope().SetName(binName)
+	sm.Scope().SetVersion(version.Version)
+
+	byName := map[string]pmetric.NumberDataPointSlice{}
+
+	for _, ts := range writeRequest.Timeseries {
+		name := ""
+		for _, label := range ts.Labels {
+			if label.Name == "__name__" {
+				name = label.Value
+			}
+		}
+
+		points, ok := byName[name]
+		if !ok {
+			metric := sm.Metrics().AppendEmpty()
+			metric.SetName(name)
+
+			m := metadata[name]
+			metric.SetDescription(m.Help)
+
+			if m.Type == prompb.MetricMetadata_COUNTER {
+				sum := metric.SetEmptySum()
+				sum.SetAggregationTemporality(pmetric.AggregationTemporalityCumulative)
+				sum.SetIsMonotonic(true)
+				points = sum.DataPoints()
+			} else {
+				points = metric.SetEmptyGauge().DataPoints()
+			}
+
+			byName[name] = points
+		}
+
+		for _, sample := range ts.Samples {
+			point := points.AppendEmpty()
+			point.SetDoubleValue(sample.Value)
+
+			// OTLP marks the end of a series with a flag instead
+			if value.IsStaleNaN(sample.Value) {
+				point.SetFlags(pmetric.DefaultDataPointFlags.WithNoRecordedValue(true))
+			}
+			point.SetTimestamp(pcommon.NewTimestampFromTime(time.UnixMilli(sample.Timestamp)))
+
+			for _, label := range ts.Labels {
+				if label.Name != "__name__" {
+					point.Attributes().PutStr(label.Name, label.Value)
+				}
+			}
+
+			for _, exemplar := range ts.Exemplars {
+				if exemplar.Timestamp != sample.Timestamp {
+					continue
+				}
+
+				e := point.Exemplars().AppendEmpty()
+				e.SetDoubleValue(exemplar.Value)
+				e.SetTimestamp(pcommon.NewTimestampFromTime(time.UnixMilli(exemplar.Timestamp)))
+
+				for _, label := range exemplar.Labels {
+					e.FilteredAttributes().PutStr(label.Name, label.Value)
+				}
+			}
+		}
+	}
+
+	return md
+}
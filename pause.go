@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/proto"
+)
+
+var (
+	// Set by SIGUSR2 to pause reconnection until the next SIGUSR2
+	reconnectPauseToggled atomic.Bool
+	// Unix nanoseconds until which reconnection is paused
+	reconnectPausedUntil atomic.Int64
+
+	// Closed and replaced whenever the pause is toggled, to wake every
+	// waiting event socket
+	reconnectPauseWake   = make(chan struct{})
+	reconnectPauseWakeMu sync.Mutex
+
+	// Whether the pause has been reported, so that it is logged and pushed
+	// once rather than by every waiting event socket
+	reconnectPauseReported atomic.Bool
+)
+
+// Check whether event socket reconnection is currently paused
+func reconnectPaused() bool {
+	if reconnectPauseToggled.Load() {
+		return true
+	}
+
+	return time.Now().UnixNano() < reconnectPausedUntil.Load()
+}
+
+// Pause reconnection if it is running, or resume it if it is paused
+func toggleReconnectPause() {
+	if reconnectPaused() {
+		reconnectPauseToggled.Store(false)
+		reconnectPausedUntil.Store(0)
+		slog.Info("Received SIGUSR2, resuming event socket reconnection")
+	} else {
+		reconnectPauseToggled.Store(true)
+		slog.Info("Received SIGUSR2, pausing event socket reconnection once the current connection is lost")
+	}
+
+	reconnectPauseWakeMu.Lock()
+	close(reconnectPauseWake)
+	reconnectPauseWake = make(chan struct{})
+	reconnectPauseWakeMu.Unlock()
+}
+
+func pauseWake() <-chan struct{} {
+	reconnectPauseWakeMu.Lock()
+	defer reconnectPauseWakeMu.Unlock()
+
+	return reconnectPauseWake
+}
+
+// Block until reconnection is no longer paused or the context is cancelled,
+// returning whether reconnection was paused. This is only called between
+// connections, so pausing doesn't close a connection that is being read.
+func waitWhilePaused(ctx context.Context, sinks []MetricSink) bool {
+	if !reconnectPaused() {
+		return false
+	}
+
+	if reconnectPauseReported.CompareAndSwap(false, true) {
+		slog.Info("Event socket reconnection paused")
+		writePausedGauge(ctx, sinks, 1)
+	}
+
+	for {
+		// Taken before checking the pause, so a toggle in between isn't missed
+		wake := pauseWake()
+		if !reconnectPaused() {
+			break
+		}
+
+		var timer *time.Timer
+		var deadline <-chan time.Time
+
+		if delay := time.Until(time.Unix(0, reconnectPausedUntil.Load())); delay > 0 {
+			timer = time.NewTimer(delay)
+			deadline = timer.C
+		}
+
+		select {
+		case <-ctx.Done():
+		case <-wake:
+		case <-deadline:
+		}
+
+		if timer != nil {
+			timer.Stop()
+		}
+
+		if ctx.Err() != nil {
+			return true
+		}
+	}
+
+	if reconnectPauseReported.CompareAndSwap(true, false) {
+		slog.Info("Event socket reconnection resumed")
+		writePausedGauge(ctx, sinks, 0)
+	}
+
+	return true
+}
+
+// Push the faucet_agent_reconnect_paused gauge
+func writePausedGauge(ctx context.Context, sinks []MetricSink, value float64) {
+	writeMetrics(ctx, sinks, map[string]*dto.MetricFamily{
+		"faucet_agent_reconnect_paused": {
+			Name: proto.String("faucet_agent_reconnect_paused"),
+			Type: dto.MetricType_GAUGE.Enum(),
+			Metric: []*dto.Metric{
+				{
+					Label: []*dto.LabelPair{
+						{
+							Name:  proto.String("instance"),
+							Value: proto.String(hostname),
+						},
+					},
+					Gauge: &dto.Gauge{
+						Value: proto.Float64(value),
+					},
+					TimestampMs: proto.Int64(time.Now().UnixMilli()),
+				},
+			},
+		},
+	})
+}
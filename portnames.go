@@ -0,0 +1,51 @@
+package main
+
+import (
+	"os"
+	"strconv"
+
+	dto "github.com/prometheus/client_model/go"
+	"go.yaml.in/yaml/v3"
+	"google.golang.org/protobuf/proto"
+)
+
+// Friendly port names keyed by datapath name then port number
+var portNames map[string]map[int]string
+
+// Load a YAML file mapping datapath names to port numbers and names, e.g:
+//
+//	sw1:
+//	  1: uplink-1
+//	  2: uplink-2
+func loadPortNames(path string) (map[string]map[int]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	names := map[string]map[int]string{}
+	if err := yaml.Unmarshal(data, &names); err != nil {
+		return nil, err
+	}
+
+	return names, nil
+}
+
+// Build a port number label, plus a port_name label if the port has a name
+func portLabels(labelName string, dpName string, portNo int) []*dto.LabelPair {
+	labels := []*dto.LabelPair{
+		{
+			Name:  proto.String(labelName),
+			Value: proto.String(strconv.Itoa(portNo)),
+		},
+	}
+
+	if name, ok := portNames[dpName][portNo]; ok {
+		labels = append(labels, &dto.LabelPair{
+			Name:  proto.String("port_name"),
+			Value: proto.String(name),
+		})
+	}
+
+	return labels
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+type portKey struct {
+	dpID   int
+	portNo int
+}
+
+// Last known up or down status of each port, for counting port flaps
+type portStatusTracker struct {
+	mu       sync.Mutex
+	status   map[portKey]bool
+	lastSeen map[portKey]time.Time
+}
+
+func newPortStatusTracker() *portStatusTracker {
+	return &portStatusTracker{
+		status:   map[portKey]bool{},
+		lastSeen: map[portKey]time.Time{},
+	}
+}
+
+var portStatuses = newPortStatusTracker()
+
+// Record the status of a port, returning whether it changed from the last
+// known status. The first status seen for a port isn't a change.
+func (t *portStatusTracker) changed(dpID int, portNo int, status bool) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	key := portKey{dpID: dpID, portNo: portNo}
+	last, known := t.status[key]
+	t.status[key] = status
+	t.lastSeen[key] = time.Now()
+
+	return known && last != status
+}
+
+// Forget the ports that haven't changed within the ttl, returning the number
+// forgotten. The next status seen for a forgotten port isn't a change.
+func (t *portStatusTracker) expire(now time.Time, ttl time.Duration) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	expired := 0
+
+	for key, lastSeen := range t.lastSeen {
+		if now.Sub(lastSeen) <= ttl {
+			continue
+		}
+
+		delete(t.status, key)
+		delete(t.lastSeen, key)
+		expired++
+	}
+
+	return expired
+}
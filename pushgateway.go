@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/push"
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/proto"
+)
+
+// Pushes metrics to a prometheus pushgateway. A push replaces every metric in
+// the group, so the latest value of each series is kept like in scrape mode
+// and the whole set is pushed each time.
+type pushgatewaySink struct {
+	url   string
+	job   string
+	store *scrapeSink
+
+	// Serializes pushes so that an older set can't replace a newer one
+	mu sync.Mutex
+}
+
+func newPushgatewaySink(url string, job string, ttl time.Duration) *pushgatewaySink {
+	return &pushgatewaySink{
+		url:   url,
+		job:   job,
+		store: newScrapeSink(ttl),
+	}
+}
+
+func (s *pushgatewaySink) Name() string {
+	return "pushgateway"
+}
+
+func (s *pushgatewaySink) Write(ctx context.Context, metrics map[string]*dto.MetricFamily) error {
+	if *dryRun {
+		writeRequest, err := buildWriteRequest(metrics, *externalLabels.Load())
+		if err != nil {
+			marshalErrors.WithLabelValues(s.Name()).Inc()
+
+			slog.Error("Unable to format pushgateway request", "sink", s.Name(), "error", err.Error())
+
+			return err
+		}
+
+		logWriteRequest(s.Name(), writeRequest)
+
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// The pushgateway has no exemplars, and keeping the labels would make
+	// every event a new series in the store
+	s.store.Write(ctx, withoutExemplarLabels(metrics))
+
+	labels := *externalLabels.Load()
+
+	pusher := push.New(s.url, s.job).
+		Client(&http.Client{Timeout: *promTimeout}).
+		Grouping("instance", hostname).
+		Gatherer(groupedGatherer{store: s.store, labels: labels})
+
+	// The job is already part of the push URL
+	for _, name := range slices.Sorted(maps.Keys(labels)) {
+		if name != "job" && name != "instance" {
+			pusher = pusher.Grouping(name, labels[name])
+		}
+	}
+
+	if err := pusher.PushContext(ctx); err != nil {
+		lastRemoteWriteFailure.Store(time.Now().UnixNano())
+
+		slog.Error(
+			"Unable to push metrics to pushgateway",
+			"sink",
+			s.Name(),
+			"metrics",
+			slices.Sorted(maps.Keys(metrics)),
+			"error",
+			err.Error(),
+		)
+
+		return err
+	}
+
+	lastRemoteWriteSuccess.Store(time.Now().UnixNano())
+
+	return nil
+}
+
+// Gathers the stored series without the instance and external labels, which
+// the pushgateway adds back from the grouping key
+type groupedGatherer struct {
+	store  *scrapeSink
+	labels map[string]string
+}
+
+func (g groupedGatherer) Gather() ([]*dto.MetricFamily, error) {
+	families, err := g.store.Gather()
+	if err != nil {
+		return nil, err
+	}
+
+	for i, family := range families {
+		family = proto.CloneOf(family)
+
+		for _, metric := range family.Metric {
+			metric.Label = slices.DeleteFunc(metric.Label, func(label *dto.LabelPair) bool {
+				_, external := g.labels[label.GetName()]
+
+				return label.GetName() == "instance" || external
+			})
+		}
+
+		families[i] = family
+	}
+
+	return families, nil
+}
+
+func withoutExemplarLabels(metrics map[string]*dto.MetricFamily) map[string]*dto.MetricFamily {
+	stripped := make(map[string]*dto.MetricFamily, len(metrics))
+
+	for name, family := range metrics {
+		family = proto.CloneOf(family)
+
+		for _, metric := range family.Metric {
+			metric.Label = slices.DeleteFunc(metric.Label, func(label *dto.LabelPair) bool {
+				return strings.HasPrefix(label.GetName(), exemplarLabelPrefix)
+			})
+		}
+
+		stripped[name] = family
+	}
+
+	return stripped
+}
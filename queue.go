@@ -0,0 +1,257 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/prometheus/storage/remote"
+	"golang.org/x/time/rate"
+)
+
+const queueFileSuffix = ".req"
+
+var unsafeQueueDirChars = regexp.MustCompile(`[^A-Za-z0-9._-]`)
+
+// An on-disk queue of encoded write requests that failed to send, replayed
+// once the receiver recovers. Each request is stored in its own file, named
+// by a sequence number so that files sort oldest first.
+type diskQueue struct {
+	mu       sync.Mutex
+	dir      string
+	maxBytes int64
+	next     uint64
+	wake     chan struct{}
+	evicted  prometheus.Counter
+}
+
+// Open the queue for a sink in a subdirectory of dir, picking up any
+// requests left over from a previous run
+func newDiskQueue(dir string, sinkName string, maxBytes int64) (*diskQueue, error) {
+	q := &diskQueue{
+		dir:      filepath.Join(dir, unsafeQueueDirChars.ReplaceAllString(sinkName, "_")),
+		maxBytes: maxBytes,
+		wake:     make(chan struct{}, 1),
+		evicted:  queueEvicted.WithLabelValues(sinkName),
+	}
+
+	if err := os.MkdirAll(q.dir, 0o750); err != nil {
+		return nil, err
+	}
+
+	files, err := q.files()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(files) > 0 {
+		var last uint64
+		if _, err := fmt.Sscanf(files[len(files)-1], "%d"+queueFileSuffix, &last); err == nil {
+			q.next = last + 1
+		}
+
+		slog.Info("Found queued write requests", "dir", q.dir, "requests", len(files))
+	}
+
+	return q, nil
+}
+
+// Queued request file names, oldest first
+func (q *diskQueue) files() ([]string, error) {
+	entries, err := os.ReadDir(q.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	files := []string{}
+	for _, entry := range entries {
+		if entry.Type().IsRegular() && strings.HasSuffix(entry.Name(), queueFileSuffix) {
+			files = append(files, entry.Name())
+		}
+	}
+
+	slices.Sort(files)
+
+	return files, nil
+}
+
+// Append a request to the queue, evicting the oldest requests if the queue
+// grows beyond its size limit
+func (q *diskQueue) push(request []byte) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	name := fmt.Sprintf("%020d%s", q.next, queueFileSuffix)
+	q.next++
+
+	tmp := filepath.Join(q.dir, name+".tmp")
+	if err := os.WriteFile(tmp, request, 0o640); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp, filepath.Join(q.dir, name)); err != nil {
+		return err
+	}
+
+	if err := q.evict(); err != nil {
+		return err
+	}
+
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+
+	return nil
+}
+
+func (q *diskQueue) evict() error {
+	if q.maxBytes <= 0 {
+		return nil
+	}
+
+	files, err := q.files()
+	if err != nil {
+		return err
+	}
+
+	sizes := make([]int64, len(files))
+	total := int64(0)
+
+	for i, file := range files {
+		info, err := os.Stat(filepath.Join(q.dir, file))
+		if err != nil {
+			return err
+		}
+
+		sizes[i] = info.Size()
+		total += sizes[i]
+	}
+
+	// Always keep the newest request, even if it is over the limit on its own
+	for i := 0; total > q.maxBytes && i < len(files)-1; i++ {
+		if err := os.Remove(filepath.Join(q.dir, files[i])); err != nil {
+			return err
+		}
+
+		total -= sizes[i]
+
+		slog.Warn("Evicted oldest queued write request", "dir", q.dir, "file", files[i])
+		q.evicted.Inc()
+	}
+
+	return nil
+}
+
+// Oldest queued request, or an empty name if the queue is empty
+func (q *diskQueue) peek() (string, []byte, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	files, err := q.files()
+	if err != nil || len(files) == 0 {
+		return "", nil, err
+	}
+
+	request, err := os.ReadFile(filepath.Join(q.dir, files[0]))
+	if err != nil {
+		return "", nil, err
+	}
+
+	return files[0], request, nil
+}
+
+func (q *diskQueue) remove(name string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return os.Remove(filepath.Join(q.dir, name))
+}
+
+// Resend queued requests in order until the context is cancelled, backing
+// off while the receiver is still failing
+func (q *diskQueue) replay(ctx context.Context, client func() remote.WriteClient, limiter *rate.Limiter) {
+	attempts := 0
+
+	for {
+		name, request, err := q.peek()
+		if err != nil {
+			slog.Error("Failed to read write request queue", "dir", q.dir, "error", err.Error())
+		}
+
+		if name == "" {
+			select {
+			case <-ctx.Done():
+				return
+			case <-q.wake:
+				continue
+			}
+		}
+
+		if err := limiter.Wait(ctx); err != nil {
+			return
+		}
+
+		storeCtx, cancel := context.WithTimeout(ctx, *promTimeout)
+		_, err = client().Store(storeCtx, request, attempts)
+		cancel()
+
+		var recoverable remote.RecoverableError
+
+		switch {
+		case err == nil:
+			slog.Debug("Replayed queued write request", "dir", q.dir, "file", name)
+		case errors.As(err, &recoverable):
+			if ctx.Err() != nil {
+				return
+			}
+
+			delay := backoff(*initialBackoff, *maxBackoff, attempts)
+
+			slog.Warn(
+				"Failed to replay queued write request, will retry",
+				"dir",
+				q.dir,
+				"file",
+				name,
+				"backoff",
+				delay,
+				"error",
+				err.Error(),
+			)
+
+			backoffDelay(ctx, delay)
+			attempts++
+
+			continue
+		default:
+			slog.Error(
+				"Dropping queued write request rejected by receiver",
+				"dir",
+				q.dir,
+				"file",
+				name,
+				"error",
+				err.Error(),
+			)
+		}
+
+		attempts = 0
+
+		if err := q.remove(name); err != nil {
+			slog.Error("Failed to remove queued write request", "dir", q.dir, "file", name, "error", err.Error())
+
+			// Avoid spinning on a request that can't be removed
+			backoffDelay(ctx, time.Second)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/model/relabel"
+	"github.com/prometheus/prometheus/prompb"
+	"go.yaml.in/yaml/v3"
+)
+
+// Relabel rules applied to every series before it is written
+var relabelConfigs []*relabel.Config
+
+// Load a YAML file holding a list of prometheus relabel configs, in the same
+// format as write_relabel_configs, e.g:
+//
+//   - source_labels: [dp_name]
+//     regex: lab-.*
+//     action: drop
+//   - regex: dp_id
+//     action: labeldrop
+func loadRelabelConfigs(path string) ([]*relabel.Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var configs []*relabel.Config
+	if err := yaml.Unmarshal(data, &configs); err != nil {
+		return nil, err
+	}
+
+	for i, config := range configs {
+		if config == nil {
+			return nil, fmt.Errorf("empty relabel config at index %d", i)
+		}
+
+		if err := config.Validate(nameValidationScheme()); err != nil {
+			return nil, fmt.Errorf("relabel config at index %d: %w", i, err)
+		}
+	}
+
+	return configs, nil
+}
+
+// Apply the relabel rules to the series in a write request, removing the
+// series that are dropped or left without any labels
+func relabelTimeseries(writeRequest *prompb.WriteRequest, configs []*relabel.Config) {
+	builder := labels.NewBuilder(labels.EmptyLabels())
+	kept := writeRequest.Timeseries[:0]
+
+	for _, ts := range writeRequest.Timeseries {
+		builder.Reset(labels.EmptyLabels())
+		for _, label := range ts.Labels {
+			builder.Set(label.Name, label.Value)
+		}
+
+		if !relabel.ProcessBuilder(builder, configs...) {
+			continue
+		}
+
+		relabeled := builder.Labels()
+		if relabeled.IsEmpty() {
+			continue
+		}
+
+		ts.Labels = make([]prompb.Label, 0, relabeled.Len())
+		relabeled.Range(func(label labels.Label) {
+			ts.Labels = append(ts.Labels, prompb.Label{Name: label.Name, Value: label.Value})
+		})
+
+		kept = append(kept, ts)
+	}
+
+	writeRequest.Timeseries = kept
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"os"
+
+	"github.com/peterbourgon/ff/v4"
+	"github.com/prometheus/prometheus/storage/remote"
+)
+
+// Accepts and discards the value of a flag that isn't reloaded
+type ignoredFlag struct {
+	isBool bool
+}
+
+func (f *ignoredFlag) String() string   { return "" }
+func (f *ignoredFlag) Set(string) error { return nil }
+func (f *ignoredFlag) IsBoolFlag() bool { return f.isBool }
+
+// Parse the command line, environment and config file again, and replace
+// the remote write clients and external labels. Nothing is replaced unless
+// every client can be built, and each remote write sink gets its new client
+// and labels in a single swap.
+func reloadConfig(sinks []MetricSink) error {
+	fs := ff.NewFlagSet(binName)
+	fs.StringLong("config", "", "")
+	opts := addRemoteWriteFlags(fs)
+
+	// Other flags still have to parse, but keep the values from startup
+	err := flagSet.WalkFlags(func(f ff.Flag) error {
+		name, ok := f.GetLongName()
+		if !ok {
+			return nil
+		}
+
+		if _, defined := fs.GetFlag(name); defined {
+			return nil
+		}
+
+		// Only boolean flags are shown without a placeholder
+		_, err := fs.AddFlag(ff.FlagConfig{
+			LongName: name,
+			Value:    &ignoredFlag{isBool: f.GetPlaceholder() == ""},
+		})
+
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := parseFlags(fs, os.Args[1:]); err != nil {
+		return err
+	}
+
+	labels, err := parseExternalLabels(*opts.externalLabels)
+	if err != nil {
+		return err
+	}
+
+	clients := map[*remoteWriteSink]remote.WriteClient{}
+	for _, sink := range sinks {
+		if rw, ok := sink.(*remoteWriteSink); ok {
+			client, err := newRemoteWriteClient(rw.url, opts, rw.version)
+			if err != nil {
+				return err
+			}
+
+			clients[rw] = client
+		}
+	}
+
+	for rw, client := range clients {
+		rw.config.Store(&remoteWriteConfig{client: client, externalLabels: labels})
+	}
+	externalLabels.Store(&labels)
+
+	return nil
+}
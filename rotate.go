@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// A file that is rotated once it grows beyond maxSize bytes, or has been open
+// for longer than maxAge, keeping up to maxBackups old copies named path.1,
+// path.2 and so on
+type rotatingFile struct {
+	mu         sync.Mutex
+	path       string
+	maxSize    int64
+	maxAge     time.Duration
+	maxBackups int
+	file       *os.File
+	size       int64
+	opened     time.Time
+}
+
+func newRotatingFile(path string, maxSize int64, maxAge time.Duration, maxBackups int) (*rotatingFile, error) {
+	f := &rotatingFile{
+		path:       path,
+		maxSize:    maxSize,
+		maxAge:     maxAge,
+		maxBackups: maxBackups,
+	}
+
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+
+	return f, nil
+}
+
+func (f *rotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o640)
+	if err != nil {
+		return err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+
+		return err
+	}
+
+	f.file = file
+	f.size = info.Size()
+	f.opened = time.Now()
+
+	return nil
+}
+
+func (f *rotatingFile) rotate() error {
+	if err := f.file.Close(); err != nil {
+		return err
+	}
+
+	for i := f.maxBackups - 1; i >= 1; i-- {
+		_ = os.Rename(fmt.Sprintf("%s.%d", f.path, i), fmt.Sprintf("%s.%d", f.path, i+1))
+	}
+
+	if f.maxBackups > 0 {
+		if err := os.Rename(f.path, f.path+".1"); err != nil {
+			return err
+		}
+	} else if err := os.Remove(f.path); err != nil {
+		return err
+	}
+
+	return f.open()
+}
+
+func (f *rotatingFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	tooBig := f.maxSize > 0 && f.size+int64(len(p)) > f.maxSize
+	tooOld := f.maxAge > 0 && time.Since(f.opened) > f.maxAge
+
+	if f.size > 0 && (tooBig || tooOld) {
+		if err := f.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+
+	return n, err
+}
+
+// Close and reopen the file, for use after it has been moved by an
+// external log rotation tool
+func (f *rotatingFile) Reopen() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.file.Close(); err != nil {
+		return err
+	}
+
+	return f.open()
+}
+
+func (f *rotatingFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.file.Close()
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/prometheus/model/value"
+	"google.golang.org/protobuf/proto"
+)
+
+// A series held by the scrape sink, along with when it was last written
+type scrapeSeries struct {
+	family   string
+	help     string
+	metric   *dto.Metric
+	lastSeen time.Time
+}
+
+// Keeps the latest value of every series in memory so that prometheus can
+// scrape them, instead of pushing them with remote write
+type scrapeSink struct {
+	mu     sync.Mutex
+	ttl    time.Duration
+	series map[string]*scrapeSeries
+}
+
+func newScrapeSink(ttl time.Duration) *scrapeSink {
+	return &scrapeSink{
+		ttl:    ttl,
+		series: map[string]*scrapeSeries{},
+	}
+}
+
+func (s *scrapeSink) Name() string {
+	return "scrape"
+}
+
+func (s *scrapeSink) Write(ctx context.Context, metrics map[string]*dto.MetricFamily) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+
+	for name, family := range metrics {
+		for _, metric := range family.GetMetric() {
+			// Samples are exposed as current values, the scrape supplies
+			// the timestamp
+			metric = proto.CloneOf(metric)
+			metric.TimestampMs = nil
+
+			// Exemplar labels carry the event ID, which would make every
+			// event a new series, and aren't valid label names to expose
+			metric.Label = slices.DeleteFunc(metric.Label, func(label *dto.LabelPair) bool {
+				return strings.HasPrefix(label.GetName(), exemplarLabelPrefix)
+			})
+
+			// A staleness marker ends the series, there's no such thing
+			// as a stale sample when scraping
+			if value.IsStaleNaN(metric.GetGauge().GetValue()) {
+				delete(s.series, scrapeSeriesKey(name, metric))
+
+				continue
+			}
+
+			s.series[scrapeSeriesKey(name, metric)] = &scrapeSeries{
+				family:   name,
+				help:     family.GetHelp(),
+				metric:   metric,
+				lastSeen: now,
+			}
+		}
+	}
+
+	return nil
+}
+
+// Key for a series by name and labels, leaving out exemplar labels since
+// they carry the event ID, which differs for every sample of the series
+func scrapeSeriesKey(name string, metric *dto.Metric) string {
+	var key strings.Builder
+
+	key.WriteString(name)
+	for _, label := range metric.GetLabel() {
+		if strings.HasPrefix(label.GetName(), exemplarLabelPrefix) {
+			continue
+		}
+
+		key.WriteByte(0xff)
+		key.WriteString(label.GetName())
+		key.WriteByte(0xfe)
+		key.WriteString(label.GetValue())
+	}
+
+	return key.String()
+}
+
+// Type of a metric based on which value it holds
+func metricType(metric *dto.Metric) dto.MetricType {
+	switch {
+	case metric.Counter != nil:
+		return dto.MetricType_COUNTER
+	case metric.Gauge != nil:
+		return dto.MetricType_GAUGE
+	case metric.Histogram != nil:
+		return dto.MetricType_HISTOGRAM
+	case metric.Summary != nil:
+		return dto.MetricType_SUMMARY
+	default:
+		return dto.MetricType_UNTYPED
+	}
+}
+
+// Gather the stored series, expiring learn series that have not been seen
+// within the ttl. Implements prometheus.Gatherer.
+func (s *scrapeSink) Gather() ([]*dto.MetricFamily, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	families := map[string]*dto.MetricFamily{}
+
+	for key, series := range s.series {
+		if s.ttl > 0 && isLearnMetric(series.family) && time.Since(series.lastSeen) > s.ttl {
+			delete(s.series, key)
+
+			continue
+		}
+
+		family, ok := families[series.family]
+		if !ok {
+			family = &dto.MetricFamily{
+				Name: proto.String(series.family),
+				Help: proto.String(series.help),
+				Type: metricType(series.metric).Enum(),
+			}
+			families[series.family] = family
+		}
+
+		family.Metric = append(family.Metric, series.metric)
+	}
+
+	gathered := []*dto.MetricFamily{}
+	for _, family := range families {
+		gathered = append(gathered, family)
+	}
+
+	slices.SortFunc(gathered, func(a, b *dto.MetricFamily) int {
+		return strings.Compare(a.GetName(), b.GetName())
+	})
+
+	return gathered, nil
+}
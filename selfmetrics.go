@@ -0,0 +1,362 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Reasons for dropping events or samples, used as faucet_dropped_total labels
+const (
+	dropFiltered         = "filtered"
+	dropSampled          = "sampled"
+	dropMalformed        = "malformed"
+	dropCardinalityLimit = "cardinality_limit"
+	dropParseError       = "parse_error"
+	dropOversized        = "oversized"
+	dropBufferFull       = "buffer_full"
+	dropUnknownType      = "unknown_type"
+	dropDeduplicated     = "deduplicated"
+	dropTooOld           = "too_old"
+)
+
+var (
+	selfRegistry = prometheus.NewRegistry()
+
+	eventsDropped = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "faucet_dropped_total",
+			Help: "Number of events or samples dropped before being written, by reason",
+		},
+		[]string{"reason"},
+	)
+
+	eventsReceived = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "faucet_agent_events_received_total",
+			Help: "Number of faucet events received by event type",
+		},
+		[]string{"type"},
+	)
+	eventsFiltered = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "faucet_agent_events_filtered_total",
+			Help: "Number of faucet events skipped by --event-types by event type",
+		},
+		[]string{"type"},
+	)
+	eventsSampledOut = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "faucet_agent_events_sampled_out_total",
+			Help: "Number of faucet events skipped by --sample-rate by event type",
+		},
+		[]string{"type"},
+	)
+	eventsDeduplicated = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "faucet_agent_events_deduplicated_total",
+			Help: "Number of faucet events with learn series skipped by --dedup-window by event type",
+		},
+		[]string{"type"},
+	)
+	parseErrors = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "faucet_agent_parse_errors_total",
+			Help: "Number of event lines that could not be parsed as JSON",
+		},
+	)
+	oversizedEvents = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "faucet_agent_oversized_events_total",
+			Help: "Number of events skipped because they were larger than --max-event-size",
+		},
+	)
+	unsupportedVersions = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "faucet_agent_unsupported_event_version_total",
+			Help: "Number of events with a schema version the agent doesn't support",
+		},
+	)
+	timestampFixups = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "faucet_agent_timestamp_fixups_total",
+			Help: "Number of events with an invalid timestamp that was replaced by the current time",
+		},
+	)
+	datapathLastEvent = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "faucet_agent_last_event_timestamp_seconds",
+			Help: "Time the agent last received an event of any type from each datapath",
+		},
+		[]string{"dp_name"},
+	)
+	socketConnected = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "faucet_agent_socket_connected",
+			Help: "Whether the agent is connected to the event socket",
+		},
+		[]string{"socket"},
+	)
+	socketReconnects = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "faucet_agent_socket_reconnects_total",
+			Help: "Number of times the agent has reconnected to the event socket after losing or failing to make a connection",
+		},
+		[]string{"socket"},
+	)
+	socketBytesRead = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "faucet_agent_socket_bytes_read_total",
+			Help: "Number of bytes read from the event socket",
+		},
+		[]string{"socket"},
+	)
+	socketEventsProcessed = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "faucet_agent_events_processed_total",
+			Help: "Number of events read from the event socket",
+		},
+		[]string{"socket"},
+	)
+	socketLastConnect = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "faucet_agent_socket_last_connect_timestamp_seconds",
+			Help: "Time the agent last connected to the event socket",
+		},
+		[]string{"socket"},
+	)
+	socketLastDisconnect = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "faucet_agent_socket_last_disconnect_timestamp_seconds",
+			Help: "Time the agent last lost its connection to the event socket",
+		},
+		[]string{"socket"},
+	)
+
+	remoteWriteFailures = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "faucet_agent_remote_write_failures_total",
+			Help: "Number of failed prometheus remote write requests",
+		},
+		[]string{"sink"},
+	)
+	remoteWriteRejected = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "faucet_agent_remote_write_rejected_total",
+			Help: "Number of remote write requests dropped because the receiver rejected them with a permanent error",
+		},
+		[]string{"sink"},
+	)
+	queueEvicted = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "faucet_agent_queue_evicted_total",
+			Help: "Number of queued remote write requests evicted to stay within --queue-max-bytes",
+		},
+		[]string{"sink"},
+	)
+	marshalErrors = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "faucet_agent_marshal_errors_total",
+			Help: "Number of writes dropped because the metrics or event could not be encoded for the sink",
+		},
+		[]string{"sink"},
+	)
+	samplesTooOld = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "faucet_agent_samples_too_old_total",
+			Help: "Number of samples dropped before remote write because they were older than --max-sample-age",
+		},
+		[]string{"sink"},
+	)
+	remoteWriteDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "faucet_agent_remote_write_duration_seconds",
+			Help:    "Duration of prometheus remote write requests",
+			Buckets: prometheus.DefBuckets,
+			// Also exposed as a native histogram, for high resolution
+			// latency to scrapers that negotiate them, while the classic
+			// buckets stay for those that don't
+			NativeHistogramBucketFactor:     1.1,
+			NativeHistogramMaxBucketNumber:  100,
+			NativeHistogramMinResetDuration: time.Hour,
+		},
+		[]string{"sink"},
+	)
+	sinkWrites = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "faucet_agent_sink_writes_total",
+			Help: "Number of metric or event writes attempted per sink",
+		},
+		[]string{"sink"},
+	)
+	sinkWriteFailures = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "faucet_agent_sink_write_failures_total",
+			Help: "Number of failed metric or event writes per sink",
+		},
+		[]string{"sink"},
+	)
+	sinkLastSuccess = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "faucet_agent_sink_last_success_timestamp_seconds",
+			Help: "Time of the last successful metric or event write per sink",
+		},
+		[]string{"sink"},
+	)
+	sinkQueueDropped = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "faucet_agent_sink_queue_dropped_total",
+			Help: "Number of metric or event writes dropped because the sink's queue was full, per sink",
+		},
+		[]string{"sink"},
+	)
+)
+
+func init() {
+	selfRegistry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		eventsDropped,
+		eventsReceived,
+		eventsFiltered,
+		eventsSampledOut,
+		eventsDeduplicated,
+		parseErrors,
+		oversizedEvents,
+		unsupportedVersions,
+		timestampFixups,
+		datapathLastEvent,
+		socketConnected,
+		socketReconnects,
+		socketBytesRead,
+		socketEventsProcessed,
+		socketLastConnect,
+		socketLastDisconnect,
+		remoteWriteFailures,
+		remoteWriteRejected,
+		queueEvicted,
+		marshalErrors,
+		samplesTooOld,
+		remoteWriteDuration,
+		sinkWrites,
+		sinkWriteFailures,
+		sinkLastSuccess,
+		sinkQueueDropped,
+	)
+
+	for _, reason := range []string{
+		dropFiltered,
+		dropSampled,
+		dropMalformed,
+		dropCardinalityLimit,
+		dropParseError,
+		dropOversized,
+		dropBufferFull,
+		dropUnknownType,
+		dropDeduplicated,
+		dropTooOld,
+	} {
+		eventsDropped.WithLabelValues(reason)
+	}
+}
+
+// Handler for the agent's own metrics and status page, along with the event
+// metrics when running in scrape mode
+func selfMetricsHandler() *http.ServeMux {
+	mux := http.NewServeMux()
+	gatherers := prometheus.Gatherers{selfRegistry}
+	if scrapeMetrics != nil {
+		gatherers = append(gatherers, scrapeMetrics)
+	}
+
+	mux.Handle("/metrics", promhttp.HandlerFor(gatherers, promhttp.HandlerOpts{}))
+	mux.HandleFunc("/{$}", handleStatus)
+
+	return mux
+}
+
+// Build the TLS configuration for the metrics and health endpoints, or nil
+// to serve plain HTTP when no certificate is set. With a client CA, every
+// request needs a client certificate signed by it.
+func metricsTLSConfig(certFile string, keyFile string, clientCAFile string) (*tls.Config, error) {
+	if certFile == "" {
+		return nil, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if clientCAFile != "" {
+		pem, err := os.ReadFile(clientCAFile)
+		if err != nil {
+			return nil, err
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", clientCAFile)
+		}
+
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return config, nil
+}
+
+// Serve HTTP on an address until the context is cancelled, over TLS when a
+// TLS configuration is given. Failing to bind the listen address is returned
+// to the caller so that it can decide whether to continue without the
+// endpoint.
+func serveHTTP(ctx context.Context, address string, handler http.Handler, tlsConfig *tls.Config) error {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+
+	if tlsConfig != nil {
+		listener = tls.NewListener(listener, tlsConfig)
+	}
+
+	server := &http.Server{
+		Handler:           handler,
+		ReadHeaderTimeout: timeout,
+	}
+
+	go func() {
+		<-ctx.Done()
+
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		_ = server.Shutdown(shutdownCtx)
+	}()
+
+	go func() {
+		if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("HTTP server stopped", "address", address, "error", err.Error())
+		}
+	}()
+
+	slog.Info("Serving HTTP", "address", listener.Addr().String(), "tls", tlsConfig != nil)
+
+	return nil
+}
@@ -0,0 +1,721 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/snappy"
+	remoteapi "github.com/prometheus/client_golang/exp/api/remote"
+	dto "github.com/prometheus/client_model/go"
+	prom_config "github.com/prometheus/common/config"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/prometheus/prometheus/storage/remote"
+	"github.com/prometheus/prometheus/util/fmtutil"
+	"golang.org/x/time/rate"
+)
+
+// Labels with this prefix are not part of the series, they are moved to an
+// exemplar on the sample by sinks that support exemplars
+const exemplarLabelPrefix = "__exemplar_"
+
+// A destination for the metrics derived from faucet events
+type MetricSink interface {
+	Name() string
+	Write(ctx context.Context, metrics map[string]*dto.MetricFamily) error
+}
+
+// Sinks that may be given with --sink
+var sinkTypeNames = []string{"remote-write", "otlp", "pushgateway", "kafka", "file"}
+
+// A destination for the events themselves, rather than the metrics built from
+// them
+type EventSink interface {
+	Name() string
+	WriteEvent(ctx context.Context, event FaucetEvent) error
+}
+
+// Create a remote write client for a URL using the configured HTTP options
+func newRemoteWriteClient(u *url.URL, opts *remoteWriteFlags, version string) (remote.WriteClient, error) {
+	httpConfig := prom_config.HTTPClientConfig{
+		TLSConfig: prom_config.TLSConfig{
+			CAFile:             *opts.tlsCA,
+			CertFile:           *opts.tlsCert,
+			KeyFile:            *opts.tlsKey,
+			InsecureSkipVerify: *opts.tlsInsecure,
+		},
+	}
+
+	if *opts.username != "" || *opts.password != "" || *opts.passwordFile != "" {
+		httpConfig.BasicAuth = &prom_config.BasicAuth{
+			Username:     *opts.username,
+			Password:     prom_config.Secret(*opts.password),
+			PasswordFile: *opts.passwordFile,
+		}
+	}
+
+	if *opts.token != "" || *opts.tokenFile != "" {
+		httpConfig.Authorization = &prom_config.Authorization{
+			Type:            "Bearer",
+			Credentials:     prom_config.Secret(*opts.token),
+			CredentialsFile: *opts.tokenFile,
+		}
+	}
+
+	if *opts.proxyURL != "" {
+		proxyURL, err := url.Parse(*opts.proxyURL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy url: %w", err)
+		}
+
+		httpConfig.ProxyConfig = prom_config.ProxyConfig{
+			ProxyURL: prom_config.URL{URL: proxyURL},
+			NoProxy:  cmp.Or(os.Getenv("NO_PROXY"), os.Getenv("no_proxy")),
+		}
+	} else {
+		httpConfig.ProxyFromEnvironment = true
+	}
+
+	if err := httpConfig.Validate(); err != nil {
+		return nil, err
+	}
+
+	headers := map[string]string{}
+	for _, header := range *opts.headers {
+		name, value, ok := strings.Cut(header, "=")
+		if !ok || name == "" {
+			return nil, fmt.Errorf("invalid header %q, expected Name=Value", header)
+		}
+
+		headers[name] = value
+	}
+
+	protoMsg := remoteapi.WriteV1MessageType
+	if version == remoteWriteV2 {
+		protoMsg = remoteapi.WriteV2MessageType
+	}
+
+	client, err := remote.NewWriteClient(binName, &remote.ClientConfig{
+		URL:              &prom_config.URL{URL: u},
+		Timeout:          model.Duration(*promTimeout),
+		HTTPClientConfig: httpConfig,
+		Headers:          headers,
+		WriteProtoMsg:    protoMsg,
+		RetryOnRateLimit: true,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if c, ok := client.(*remote.Client); ok {
+		c.Client.Transport = retryAfterRoundTripper{next: c.Client.Transport}
+
+		// The client always declares snappy encoding
+		if *promCompression == "none" {
+			c.Client.Transport = uncompressedRoundTripper{next: c.Client.Transport}
+		}
+	}
+
+	return client, nil
+}
+
+type retryAfterKey struct{}
+
+// Delay from a Retry-After response header, passed back through the request
+// context since the client doesn't expose it
+type retryAfterHint struct {
+	delay time.Duration
+}
+
+// Records the Retry-After header of remote write responses
+type retryAfterRoundTripper struct {
+	next http.RoundTripper
+}
+
+func (rt retryAfterRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := rt.next.RoundTrip(req)
+	if err != nil {
+		return resp, err
+	}
+
+	hint, ok := req.Context().Value(retryAfterKey{}).(*retryAfterHint)
+	if !ok {
+		return resp, nil
+	}
+
+	if value := resp.Header.Get("Retry-After"); value != "" {
+		if seconds, err := strconv.Atoi(value); err == nil {
+			hint.delay = time.Duration(seconds) * time.Second
+		} else if at, err := http.ParseTime(value); err == nil {
+			hint.delay = time.Until(at)
+		}
+	}
+
+	return resp, nil
+}
+
+// Removes the Content-Encoding header from uncompressed remote write requests
+type uncompressedRoundTripper struct {
+	next http.RoundTripper
+}
+
+func (rt uncompressedRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.Header.Del("Content-Encoding")
+
+	return rt.next.RoundTrip(req)
+}
+
+// Sends metrics to prometheus via remote write
+type remoteWriteSink struct {
+	name    string
+	url     *url.URL
+	version string
+	config  atomic.Pointer[remoteWriteConfig]
+	queue   *diskQueue
+	limiter *rate.Limiter
+}
+
+// Client and external labels of a remote write sink, which are replaced
+// together when the config is reloaded, so that a write never mixes the
+// client of one config with the labels of another
+type remoteWriteConfig struct {
+	client         remote.WriteClient
+	externalLabels map[string]string
+}
+
+func newRemoteWriteSink(
+	name string,
+	u *url.URL,
+	version string,
+	client remote.WriteClient,
+	labels map[string]string,
+	queue *diskQueue,
+) *remoteWriteSink {
+	s := &remoteWriteSink{
+		name:    name,
+		url:     u,
+		version: version,
+		queue:   queue,
+		limiter: newRequestLimiter(),
+	}
+	s.config.Store(&remoteWriteConfig{client: client, externalLabels: labels})
+
+	return s
+}
+
+// Limit requests to --max-requests-per-second, with bursts of up to
+// --max-burst requests
+func newRequestLimiter() *rate.Limiter {
+	if *maxRequestRate <= 0 {
+		return rate.NewLimiter(rate.Inf, *maxBurst)
+	}
+
+	return rate.NewLimiter(rate.Limit(*maxRequestRate), *maxBurst)
+}
+
+// Current client, which is replaced when the config is reloaded
+func (s *remoteWriteSink) writeClient() remote.WriteClient {
+	return s.config.Load().client
+}
+
+func (s *remoteWriteSink) Name() string {
+	return s.name
+}
+
+// Convert metric families to a remote write request carrying the external
+// labels, with exemplar labels moved to exemplars
+func buildWriteRequest(metrics map[string]*dto.MetricFamily, labels map[string]string) (*prompb.WriteRequest, error) {
+	writeRequest, err := fmtutil.MetricFamiliesToWriteRequest(
+		metrics,
+		labels,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	overrideExternalLabels(writeRequest, labels)
+	moveExemplarLabels(writeRequest)
+
+	// After the external labels are added, like write_relabel_configs
+	if len(relabelConfigs) > 0 {
+		relabelTimeseries(writeRequest, relabelConfigs)
+	}
+
+	dedupTimeseries(writeRequest)
+
+	return writeRequest, nil
+}
+
+func (s *remoteWriteSink) Write(ctx context.Context, metrics map[string]*dto.MetricFamily) error {
+	// Loaded once, so that a reload during the write doesn't send the
+	// request with a client from another config
+	config := s.config.Load()
+
+	writeRequest, err := buildWriteRequest(metrics, config.externalLabels)
+	if err != nil {
+		marshalErrors.WithLabelValues(s.name).Inc()
+
+		slog.Error(
+			"Unable to format write request",
+			"sink",
+			s.name,
+			"metrics",
+			slices.Sorted(maps.Keys(metrics)),
+			"error",
+			err.Error(),
+		)
+
+		return err
+	}
+
+	if *maxSampleAge > 0 {
+		if dropped := dropOldSamples(writeRequest, time.Now().Add(-*maxSampleAge)); dropped > 0 {
+			samplesTooOld.WithLabelValues(s.name).Add(float64(dropped))
+			eventsDropped.WithLabelValues(dropTooOld).Add(float64(dropped))
+
+			slog.Warn(
+				"Dropping samples older than maximum sample age",
+				"sink",
+				s.name,
+				"samples",
+				dropped,
+				"max_sample_age",
+				*maxSampleAge,
+			)
+		}
+	}
+
+	// Don't send an empty request, for example when every sample was too old
+	if len(writeRequest.Timeseries) == 0 {
+		return nil
+	}
+
+	if *dryRun {
+		logWriteRequest(s.name, writeRequest)
+
+		return nil
+	}
+
+	// Receivers limit the size of request bodies, so large batches are sent
+	// in several requests
+	if *maxReqSamples > 0 && len(writeRequest.Timeseries) > *maxReqSamples {
+		var errs []error
+
+		for chunk := range slices.Chunk(writeRequest.Timeseries, *maxReqSamples) {
+			errs = append(errs, s.send(ctx, config.client, metrics, &prompb.WriteRequest{
+				Timeseries: chunk,
+				Metadata:   writeRequest.Metadata,
+			}))
+		}
+
+		return errors.Join(errs...)
+	}
+
+	return s.send(ctx, config.client, metrics, writeRequest)
+}
+
+// Encode and send a write request, retrying and queueing it on failure
+func (s *remoteWriteSink) send(
+	ctx context.Context,
+	client remote.WriteClient,
+	metrics map[string]*dto.MetricFamily,
+	writeRequest *prompb.WriteRequest,
+) error {
+	var rawRequest []byte
+	var err error
+	if s.version == remoteWriteV2 {
+		rawRequest, err = toWriteV2Request(writeRequest).Marshal()
+	} else {
+		rawRequest, err = writeRequest.Marshal()
+	}
+	if err != nil {
+		marshalErrors.WithLabelValues(s.name).Inc()
+
+		slog.Error(
+			"Unable to marshal write request",
+			"sink",
+			s.name,
+			"metrics",
+			slices.Sorted(maps.Keys(metrics)),
+			"error",
+			err.Error(),
+		)
+
+		return err
+	}
+
+	compressedRequest := rawRequest
+	if *promCompression == "snappy" {
+		compressedRequest = snappy.Encode(nil, rawRequest)
+	}
+
+	var recoverable remote.RecoverableError
+
+	for attempt := 0; ; attempt++ {
+		var retryAfter time.Duration
+
+		// Only fails once shutting down
+		if err := s.limiter.Wait(ctx); err != nil {
+			return err
+		}
+
+		retryAfter, err = s.store(ctx, client, metrics, compressedRequest, attempt)
+		if err == nil || !errors.As(err, &recoverable) || attempt >= *promRetries || ctx.Err() != nil {
+			break
+		}
+
+		delay := retryAfter
+		if delay <= 0 {
+			delay = backoff(*initialBackoff, *maxBackoff, attempt)
+		}
+
+		slog.Warn(
+			"Retrying write request",
+			"sink",
+			s.name,
+			"attempt",
+			attempt+1,
+			"backoff",
+			delay,
+		)
+
+		backoffDelay(ctx, delay)
+	}
+
+	if err != nil {
+		if !errors.As(err, &recoverable) {
+			remoteWriteRejected.WithLabelValues(s.name).Inc()
+
+			return err
+		}
+
+		// Only queue requests that may succeed later, the receiver will
+		// keep rejecting the others
+		if s.queue != nil {
+			if err := s.queue.push(compressedRequest); err != nil {
+				slog.Error("Failed to queue write request", "sink", s.name, "error", err.Error())
+			}
+		}
+
+		return err
+	}
+
+	return nil
+}
+
+// Make a single attempt at sending a write request, returning the delay the
+// receiver asked for before retrying, if any
+func (s *remoteWriteSink) store(
+	ctx context.Context,
+	client remote.WriteClient,
+	metrics map[string]*dto.MetricFamily,
+	request []byte,
+	attempt int,
+) (time.Duration, error) {
+	hint := &retryAfterHint{}
+
+	start := time.Now()
+	storeCtx, cancel := context.WithTimeout(context.WithValue(ctx, retryAfterKey{}, hint), *promTimeout)
+	_, err := client.Store(storeCtx, request, attempt)
+	timedOut := errors.Is(storeCtx.Err(), context.DeadlineExceeded)
+	cancel()
+	remoteWriteDuration.WithLabelValues(s.name).Observe(time.Since(start).Seconds())
+
+	if err != nil {
+		remoteWriteFailures.WithLabelValues(s.name).Inc()
+		lastRemoteWriteFailure.Store(time.Now().UnixNano())
+
+		message := "Unable to send write request to prometheus"
+		if timedOut {
+			message = "Timed out sending write request to prometheus"
+		}
+
+		slog.Error(
+			message,
+			"sink",
+			s.name,
+			"metrics",
+			slices.Sorted(maps.Keys(metrics)),
+			"attempt",
+			attempt,
+			"timeout",
+			*promTimeout,
+			"error",
+			err.Error(),
+		)
+
+		return hint.delay, err
+	}
+
+	lastRemoteWriteSuccess.Store(time.Now().UnixNano())
+
+	return 0, nil
+}
+
+// Log every sample in a write request instead of sending it
+func logWriteRequest(sink string, writeRequest *prompb.WriteRequest) {
+	for _, ts := range writeRequest.Timeseries {
+		series := formatLabels(ts.Labels)
+
+		for _, sample := range ts.Samples {
+			slog.Info(
+				"Dry run sample",
+				"sink",
+				sink,
+				"series",
+				series,
+				"value",
+				sample.Value,
+				"timestamp",
+				time.UnixMilli(sample.Timestamp),
+			)
+		}
+
+		for _, exemplar := range ts.Exemplars {
+			slog.Info(
+				"Dry run exemplar",
+				"sink",
+				sink,
+				"exemplar",
+				formatLabels(exemplar.Labels),
+				"value",
+				exemplar.Value,
+				"timestamp",
+				time.UnixMilli(exemplar.Timestamp),
+			)
+		}
+	}
+}
+
+// Format labels as a prometheus series selector
+func formatLabels(labels []prompb.Label) string {
+	pairs := make([]string, 0, len(labels))
+	for _, label := range labels {
+		// UTF-8 names are quoted in selectors
+		if model.LegacyValidation.IsValidLabelName(label.Name) {
+			pairs = append(pairs, fmt.Sprintf("%s=%q", label.Name, label.Value))
+		} else {
+			pairs = append(pairs, fmt.Sprintf("%q=%q", label.Name, label.Value))
+		}
+	}
+
+	return "{" + strings.Join(pairs, ", ") + "}"
+}
+
+// Parse external labels given as name=value, on top of the job and instance
+// labels
+func parseExternalLabels(pairs []string) (map[string]string, error) {
+	// Series already carry instance, it's added here too so that receivers
+	// see it like job. Both may be overridden with --external-label.
+	labels := map[string]string{"instance": hostname}
+	if *jobName != "" {
+		labels["job"] = *jobName
+	}
+
+	for _, pair := range pairs {
+		name, value, ok := strings.Cut(pair, "=")
+		if !ok || !nameValidationScheme().IsValidLabelName(name) {
+			return nil, fmt.Errorf("invalid external label %q, expected name=value", pair)
+		}
+
+		labels[name] = value
+	}
+
+	return labels, nil
+}
+
+var (
+	// Labels added to every remote written metric, replaced when the config
+	// is reloaded
+	externalLabels atomic.Pointer[map[string]string]
+
+	// External label names already logged as colliding with event labels
+	externalLabelCollisions sync.Map
+)
+
+// Replace event labels that collide with an external label. Labels are
+// already sorted, so values are replaced in place.
+func overrideExternalLabels(writeRequest *prompb.WriteRequest, externalLabels map[string]string) {
+	if len(externalLabels) == 0 {
+		return
+	}
+
+	for i := range writeRequest.Timeseries {
+		ts := &writeRequest.Timeseries[i]
+
+		for j, label := range ts.Labels {
+			value, ok := externalLabels[label.Name]
+			if !ok || value == label.Value {
+				continue
+			}
+
+			if _, logged := externalLabelCollisions.LoadOrStore(label.Name, true); !logged {
+				slog.Warn(
+					"External label overrides event label",
+					"label",
+					label.Name,
+					"event_value",
+					label.Value,
+					"external_value",
+					value,
+				)
+			}
+
+			ts.Labels[j].Value = value
+		}
+	}
+}
+
+// Strip exemplar labels from each timeseries and attach them to an exemplar
+// for the series' sample instead
+func moveExemplarLabels(writeRequest *prompb.WriteRequest) {
+	for i := range writeRequest.Timeseries {
+		ts := &writeRequest.Timeseries[i]
+
+		var exemplarLabels []prompb.Label
+
+		seriesLabels := ts.Labels[:0]
+		for _, label := range ts.Labels {
+			if name, ok := strings.CutPrefix(label.Name, exemplarLabelPrefix); ok {
+				exemplarLabels = append(exemplarLabels, prompb.Label{Name: name, Value: label.Value})
+			} else {
+				seriesLabels = append(seriesLabels, label)
+			}
+		}
+		ts.Labels = seriesLabels
+
+		if len(exemplarLabels) == 0 {
+			continue
+		}
+
+		for _, sample := range ts.Samples {
+			ts.Exemplars = append(ts.Exemplars, prompb.Exemplar{
+				Labels:    exemplarLabels,
+				Value:     sample.Value,
+				Timestamp: sample.Timestamp,
+			})
+		}
+	}
+}
+
+// Replace earlier samples for the same series and timestamp with the last
+// one in the request, since receivers reject duplicate samples
+func dedupTimeseries(writeRequest *prompb.WriteRequest) {
+	seen := map[string]int{}
+	deduped := writeRequest.Timeseries[:0]
+
+	for _, ts := range writeRequest.Timeseries {
+		// Timeseries built from metric families hold exactly one sample
+		if len(ts.Samples) != 1 {
+			deduped = append(deduped, ts)
+
+			continue
+		}
+
+		var key strings.Builder
+		for _, label := range ts.Labels {
+			key.WriteString(label.Name)
+			key.WriteByte(0xfe)
+			key.WriteString(label.Value)
+			key.WriteByte(0xff)
+		}
+		key.WriteString(strconv.FormatInt(ts.Samples[0].Timestamp, 10))
+
+		if i, ok := seen[key.String()]; ok {
+			deduped[i] = ts
+
+			continue
+		}
+
+		seen[key.String()] = len(deduped)
+		deduped = append(deduped, ts)
+	}
+
+	writeRequest.Timeseries = deduped
+}
+
+// Remove samples and exemplars older than the cutoff, along with timeseries
+// left without samples, returning the number of samples removed. Receivers
+// reject samples outside their out-of-order window, which fails the whole
+// request.
+func dropOldSamples(writeRequest *prompb.WriteRequest, cutoff time.Time) int {
+	cutoffMs := cutoff.UnixMilli()
+	dropped := 0
+	kept := writeRequest.Timeseries[:0]
+
+	for _, ts := range writeRequest.Timeseries {
+		samples := len(ts.Samples)
+		ts.Samples = slices.DeleteFunc(ts.Samples, func(sample prompb.Sample) bool {
+			return sample.Timestamp < cutoffMs
+		})
+		dropped += samples - len(ts.Samples)
+
+		if len(ts.Samples) == 0 {
+			continue
+		}
+
+		ts.Exemplars = slices.DeleteFunc(ts.Exemplars, func(exemplar prompb.Exemplar) bool {
+			return exemplar.Timestamp < cutoffMs
+		})
+
+		kept = append(kept, ts)
+	}
+
+	writeRequest.Timeseries = kept
+
+	return dropped
+}
+
+// Queue metric families for every sink without waiting for them to be
+// written, so that a slow or failing sink doesn't hold up the others. Sinks
+// without a queue are written to concurrently before returning.
+func writeMetrics(ctx context.Context, sinks []MetricSink, metrics map[string]*dto.MetricFamily) {
+	var wg sync.WaitGroup
+
+	for _, sink := range sinks {
+		if q, ok := metricSinkQueues[sink]; ok {
+			q.offer(metrics)
+
+			continue
+		}
+
+		wg.Go(func() {
+			writeToSink(ctx, sink.Name(), metrics, sink.Write)
+		})
+	}
+
+	wg.Wait()
+}
+
+// Queue an event for every event sink, like writeMetrics
+func writeEvent(ctx context.Context, sinks []EventSink, event FaucetEvent) {
+	var wg sync.WaitGroup
+
+	for _, sink := range sinks {
+		if q, ok := eventSinkQueues[sink]; ok {
+			q.offer(event)
+
+			continue
+		}
+
+		wg.Go(func() {
+			writeToSink(ctx, sink.Name(), event, sink.WriteEvent)
+		})
+	}
+
+	wg.Wait()
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"sync"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+// Hands writes to a sink on a goroutine of its own through a bounded queue,
+// so that a slow or failing sink only holds up its own writes. Writes that
+// arrive while the queue is full are dropped and counted for the sink.
+type sinkQueue[T any] struct {
+	name  string
+	write func(context.Context, T) error
+
+	// Held for reading while offering, so that the queue isn't closed under
+	// a write
+	mu     sync.RWMutex
+	closed bool
+	items  chan T
+	done   chan struct{}
+}
+
+func startSinkQueue[T any](ctx context.Context, name string, size int, write func(context.Context, T) error) *sinkQueue[T] {
+	q := &sinkQueue[T]{
+		name:  name,
+		write: write,
+		items: make(chan T, size),
+		done:  make(chan struct{}),
+	}
+
+	go q.run(ctx)
+
+	return q
+}
+
+// Queue a write without waiting, dropping it if the queue is full or stopped
+func (q *sinkQueue[T]) offer(item T) {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+
+	if q.closed {
+		sinkQueueDropped.WithLabelValues(q.name).Inc()
+
+		return
+	}
+
+	select {
+	case q.items <- item:
+	default:
+		sinkQueueDropped.WithLabelValues(q.name).Inc()
+	}
+}
+
+func (q *sinkQueue[T]) run(ctx context.Context) {
+	defer close(q.done)
+
+	for item := range q.items {
+		writeToSink(ctx, q.name, item, q.write)
+	}
+}
+
+// Stop accepting writes and wait for the queued ones to be written
+func (q *sinkQueue[T]) stop() {
+	q.mu.Lock()
+	if !q.closed {
+		q.closed = true
+		close(q.items)
+	}
+	q.mu.Unlock()
+
+	<-q.done
+}
+
+// Make a write to a sink, counting it in the sink's metrics
+func writeToSink[T any](ctx context.Context, name string, item T, write func(context.Context, T) error) {
+	sinkWrites.WithLabelValues(name).Inc()
+
+	if err := write(ctx, item); err != nil {
+		sinkWriteFailures.WithLabelValues(name).Inc()
+	} else {
+		sinkLastSuccess.WithLabelValues(name).SetToCurrentTime()
+	}
+}
+
+var (
+	// Queues for the metric and event sinks, set once before any events are
+	// handled. Sinks without a queue are written to directly.
+	metricSinkQueues map[MetricSink]*sinkQueue[map[string]*dto.MetricFamily]
+	eventSinkQueues  map[EventSink]*sinkQueue[FaucetEvent]
+)
+
+// Start a queue of --sink-queue-size writes for every metric and event sink,
+// returning a function that stops the queues once their writes are done.
+// Writes use ctx, so cancelling it abandons the writes still queued.
+func startSinkQueues(ctx context.Context, sinks []MetricSink, events []EventSink) func() {
+	metricSinkQueues = map[MetricSink]*sinkQueue[map[string]*dto.MetricFamily]{}
+	for _, sink := range sinks {
+		metricSinkQueues[sink] = startSinkQueue(ctx, sink.Name(), *sinkQueueSize, sink.Write)
+	}
+
+	eventSinkQueues = map[EventSink]*sinkQueue[FaucetEvent]{}
+	for _, sink := range events {
+		eventSinkQueues[sink] = startSinkQueue(ctx, sink.Name(), *sinkQueueSize, sink.WriteEvent)
+	}
+
+	return func() {
+		var wg sync.WaitGroup
+
+		for _, q := range metricSinkQueues {
+			wg.Go(q.stop)
+		}
+
+		for _, q := range eventSinkQueues {
+			wg.Go(q.stop)
+		}
+
+		wg.Wait()
+	}
+}
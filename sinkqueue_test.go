@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// Signals every write made to it on written
+type recordingSink struct {
+	name    string
+	written chan struct{}
+}
+
+func (s *recordingSink) Name() string {
+	return s.name
+}
+
+func (s *recordingSink) Write(ctx context.Context, metrics map[string]*dto.MetricFamily) error {
+	s.written <- struct{}{}
+
+	return nil
+}
+
+// Start queues for the sinks, tearing them down along with the test
+func startTestSinkQueues(t *testing.T, size int, sinks []MetricSink, events []EventSink) func() {
+	t.Helper()
+
+	saved := *sinkQueueSize
+	*sinkQueueSize = size
+
+	stop := startSinkQueues(context.Background(), sinks, events)
+
+	t.Cleanup(func() {
+		stop()
+		*sinkQueueSize = saved
+		metricSinkQueues = nil
+		eventSinkQueues = nil
+	})
+
+	return stop
+}
+
+func TestBlockedSinkDoesNotDelayOthers(t *testing.T) {
+	const writes = 10
+
+	blocked := &blockingSink{release: make(chan struct{})}
+	healthy := &recordingSink{name: "healthy", written: make(chan struct{}, writes)}
+
+	startTestSinkQueues(t, writes, []MetricSink{blocked, healthy}, nil)
+	defer close(blocked.release)
+
+	// Written from another goroutine, so that a write that waits for the
+	// blocked sink fails the test instead of hanging it
+	go func() {
+		for range writes {
+			writeMetrics(context.Background(), []MetricSink{blocked, healthy}, map[string]*dto.MetricFamily{})
+		}
+	}()
+
+	for i := range writes {
+		select {
+		case <-healthy.written:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("healthy sink got %d of %d writes while the other sink was blocked", i, writes)
+		}
+	}
+}
+
+func TestSinkQueueDropsWhenFull(t *testing.T) {
+	const size = 2
+
+	blocked := &blockingSink{release: make(chan struct{})}
+	stop := startTestSinkQueues(t, size, []MetricSink{blocked}, nil)
+
+	dropped := sinkQueueDropped.WithLabelValues(blocked.Name())
+	before := testutil.ToFloat64(dropped)
+
+	// The first write is taken off the queue and blocks the sink, the
+	// queue holds the next ones and the rest are dropped
+	writeMetrics(context.Background(), []MetricSink{blocked}, map[string]*dto.MetricFamily{})
+	waitFor(t, "the first write to be taken off the queue", func() bool {
+		return len(metricSinkQueues[blocked].items) == 0
+	})
+
+	for range size + 3 {
+		writeMetrics(context.Background(), []MetricSink{blocked}, map[string]*dto.MetricFamily{})
+	}
+
+	if got := testutil.ToFloat64(dropped) - before; got != 3 {
+		t.Errorf("got %v dropped writes, want 3", got)
+	}
+
+	// Queued writes are still made once the sink recovers
+	close(blocked.release)
+	stop()
+
+	if blocked.writes != size+1 {
+		t.Errorf("got %d writes, want %d", blocked.writes, size+1)
+	}
+}
+
+// Blocks every event written to it until released
+type blockingEventSink struct {
+	release chan struct{}
+}
+
+func (s *blockingEventSink) Name() string {
+	return "blocking_events"
+}
+
+func (s *blockingEventSink) WriteEvent(ctx context.Context, event FaucetEvent) error {
+	select {
+	case <-s.release:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func TestBlockedEventSinkDoesNotDelayEvents(t *testing.T) {
+	blocked := &blockingEventSink{release: make(chan struct{})}
+
+	startTestSinkQueues(t, 10, nil, []EventSink{blocked})
+	defer close(blocked.release)
+
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		for range 5 {
+			writeEvent(context.Background(), []EventSink{blocked}, FaucetEvent{DpChange: &DpChange{}})
+		}
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("writing events waited for the blocked event sink")
+	}
+}
+
+// Fails every write made to it
+type failingSink struct{}
+
+func (failingSink) Name() string {
+	return "failing"
+}
+
+func (failingSink) Write(ctx context.Context, metrics map[string]*dto.MetricFamily) error {
+	return errors.New("receiver unavailable")
+}
+
+func TestSinkFailuresAreCountedPerSink(t *testing.T) {
+	const writes = 3
+
+	healthy := &recordingSink{name: "healthy_receiver", written: make(chan struct{}, writes)}
+	sinks := []MetricSink{failingSink{}, healthy}
+
+	failingFailures := sinkWriteFailures.WithLabelValues("failing")
+	healthyFailures := sinkWriteFailures.WithLabelValues(healthy.Name())
+	beforeFailing := testutil.ToFloat64(failingFailures)
+	beforeHealthy := testutil.ToFloat64(healthyFailures)
+
+	stop := startTestSinkQueues(t, writes, sinks, nil)
+
+	for range writes {
+		writeMetrics(context.Background(), sinks, map[string]*dto.MetricFamily{})
+	}
+
+	for i := range writes {
+		select {
+		case <-healthy.written:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("healthy sink got %d of %d writes", i, writes)
+		}
+	}
+
+	stop()
+
+	if got := testutil.ToFloat64(failingFailures) - beforeFailing; got != writes {
+		t.Errorf("got %v failures for the failing sink, want %d", got, writes)
+	}
+
+	if got := testutil.ToFloat64(healthyFailures) - beforeHealthy; got != 0 {
+		t.Errorf("got %v failures for the healthy sink, want 0", got)
+	}
+
+	if testutil.ToFloat64(sinkLastSuccess.WithLabelValues("failing")) != 0 {
+		t.Error("failing sink has a last success time")
+	}
+}
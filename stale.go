@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"math"
+	"sync"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/prometheus/model/value"
+	"google.golang.org/protobuf/proto"
+)
+
+// A learn series written with remote write, along with when it was last
+// written
+type staleSeries struct {
+	family   string
+	help     string
+	labels   []*dto.LabelPair
+	lastSeen time.Time
+}
+
+// Tracks learn series written with remote write, so that series which haven't
+// been updated within the ttl can be ended with a staleness marker instead of
+// showing the host until the series falls out of the query lookback
+type stalenessTracker struct {
+	mu     sync.Mutex
+	ttl    time.Duration
+	series map[string]*staleSeries
+}
+
+func newStalenessTracker(ttl time.Duration) *stalenessTracker {
+	return &stalenessTracker{
+		ttl:    ttl,
+		series: map[string]*staleSeries{},
+	}
+}
+
+// Record the learn series in a set of metrics as seen
+func (t *stalenessTracker) observe(metrics map[string]*dto.MetricFamily) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+
+	for name, family := range metrics {
+		if !isLearnMetric(name) {
+			continue
+		}
+
+		for _, metric := range family.GetMetric() {
+			t.series[scrapeSeriesKey(name, metric)] = &staleSeries{
+				family:   name,
+				help:     family.GetHelp(),
+				labels:   stripExemplarLabels(metric.GetLabel()),
+				lastSeen: now,
+			}
+		}
+	}
+}
+
+// Remove the series that haven't been seen within the ttl, returning a
+// staleness marker for each of them
+func (t *stalenessTracker) expire(now time.Time) map[string]*dto.MetricFamily {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	markers := map[string]*dto.MetricFamily{}
+
+	for key, series := range t.series {
+		if now.Sub(series.lastSeen) <= t.ttl {
+			continue
+		}
+
+		delete(t.series, key)
+
+		family, ok := markers[series.family]
+		if !ok {
+			family = &dto.MetricFamily{
+				Name: proto.String(series.family),
+				Help: proto.String(series.help),
+				Type: dto.MetricType_GAUGE.Enum(),
+			}
+			markers[series.family] = family
+		}
+
+		family.Metric = append(family.Metric, &dto.Metric{
+			Label: series.labels,
+			Gauge: &dto.Gauge{
+				Value: proto.Float64(math.Float64frombits(value.StaleNaN)),
+			},
+			TimestampMs: proto.Int64(now.UnixMilli()),
+		})
+	}
+
+	return markers
+}
+
+// Periodically forget the counters, port statuses and config hashes that
+// haven't been updated within the ttl, until the context is cancelled
+func expireEventState(ctx context.Context, ttl time.Duration) {
+	ticker := time.NewTicker(min(max(ttl/2, time.Second), time.Minute))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			expired := eventCounters.expire(now, ttl) + portStatuses.expire(now, ttl) + configHashes.expire(now, ttl)
+			if expired > 0 {
+				slog.Debug("Forgetting expired event state", "entries", expired)
+			}
+		}
+	}
+}
+
+// Periodically write staleness markers for expired series until the context
+// is cancelled. Only remote write receivers understand staleness markers, so
+// other sinks are skipped.
+func (t *stalenessTracker) run(ctx context.Context, sinks []MetricSink) {
+	var remoteWriteSinks []MetricSink
+	for _, sink := range sinks {
+		if _, ok := sink.(*remoteWriteSink); ok {
+			remoteWriteSinks = append(remoteWriteSinks, sink)
+		}
+	}
+
+	ticker := time.NewTicker(min(max(t.ttl/2, time.Second), time.Minute))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			markers := t.expire(now)
+			if len(markers) == 0 {
+				continue
+			}
+
+			expired := 0
+			for _, family := range markers {
+				expired += len(family.Metric)
+			}
+
+			slog.Debug("Marking expired learn series stale", "series", expired)
+
+			writeMetrics(ctx, remoteWriteSinks, markers)
+		}
+	}
+}
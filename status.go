@@ -0,0 +1,289 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"html/template"
+	"log/slog"
+	"math"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/version"
+)
+
+const (
+	maxRecentErrors    = 20
+	eventRateInterval  = 10 * time.Second
+	statusTimestampFmt = time.RFC3339
+)
+
+var (
+	startTime = time.Now()
+
+	// Unix nanoseconds of the last received event
+	lastEventTime atomic.Int64
+	// Float64 bits of the events per second over the last sample interval
+	eventRate atomic.Uint64
+
+	recentErrors = &errorLog{}
+)
+
+// Keeps the most recent error log messages for the status page
+type errorLog struct {
+	mu      sync.Mutex
+	entries []string
+}
+
+func (l *errorLog) add(entry string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.entries = append(l.entries, entry)
+	if len(l.entries) > maxRecentErrors {
+		l.entries = l.entries[len(l.entries)-maxRecentErrors:]
+	}
+}
+
+func (l *errorLog) list() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	entries := make([]string, len(l.entries))
+	for i, entry := range l.entries {
+		entries[len(l.entries)-1-i] = entry
+	}
+
+	return entries
+}
+
+// A slog handler that remembers error records before passing them on
+type errorRecorder struct {
+	slog.Handler
+	attrs []slog.Attr
+}
+
+func newErrorRecorder(handler slog.Handler) *errorRecorder {
+	return &errorRecorder{Handler: handler}
+}
+
+func (h *errorRecorder) Handle(ctx context.Context, r slog.Record) error {
+	if r.Level >= slog.LevelError {
+		var entry strings.Builder
+
+		entry.WriteString(r.Time.Format(statusTimestampFmt))
+		entry.WriteString(" ")
+		entry.WriteString(r.Message)
+
+		writeAttr := func(attr slog.Attr) bool {
+			fmt.Fprintf(&entry, " %s=%v", attr.Key, attr.Value)
+
+			return true
+		}
+
+		for _, attr := range h.attrs {
+			writeAttr(attr)
+		}
+		r.Attrs(writeAttr)
+
+		recentErrors.add(entry.String())
+	}
+
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h *errorRecorder) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &errorRecorder{
+		Handler: h.Handler.WithAttrs(attrs),
+		attrs:   append(h.attrs[:len(h.attrs):len(h.attrs)], attrs...),
+	}
+}
+
+func (h *errorRecorder) WithGroup(name string) slog.Handler {
+	return &errorRecorder{
+		Handler: h.Handler.WithGroup(name),
+		attrs:   h.attrs,
+	}
+}
+
+// Periodically sample the events received counter to derive an event rate
+func sampleEventRate(ctx context.Context) {
+	ticker := time.NewTicker(eventRateInterval)
+	defer ticker.Stop()
+
+	previous := sumSelfMetric("faucet_agent_events_received_total")
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			current := sumSelfMetric("faucet_agent_events_received_total")
+			rate := (current - previous) / eventRateInterval.Seconds()
+			eventRate.Store(math.Float64bits(rate))
+			previous = current
+		}
+	}
+}
+
+// Gather the agent metrics, keyed by metric name
+func gatherSelfMetrics() map[string]*dto.MetricFamily {
+	families, err := selfRegistry.Gather()
+	if err != nil {
+		slog.Warn("Failed to gather agent metrics", "error", err.Error())
+	}
+
+	metrics := map[string]*dto.MetricFamily{}
+	for _, family := range families {
+		metrics[family.GetName()] = family
+	}
+
+	return metrics
+}
+
+// Value of a counter or gauge sample
+func sampleValue(metric *dto.Metric) float64 {
+	if metric.GetCounter() != nil {
+		return metric.GetCounter().GetValue()
+	}
+
+	return metric.GetGauge().GetValue()
+}
+
+// Sum all series of a counter or gauge agent metric
+func sumSelfMetric(name string) float64 {
+	total := 0.0
+
+	if family, ok := gatherSelfMetrics()[name]; ok {
+		for _, metric := range family.GetMetric() {
+			total += sampleValue(metric)
+		}
+	}
+
+	return total
+}
+
+// Values of an agent metric keyed by one of its labels
+func selfMetricByLabel(metrics map[string]*dto.MetricFamily, name string, label string) map[string]float64 {
+	values := map[string]float64{}
+
+	for _, metric := range metrics[name].GetMetric() {
+		for _, pair := range metric.GetLabel() {
+			if pair.GetName() == label {
+				values[pair.GetValue()] = sampleValue(metric)
+			}
+		}
+	}
+
+	return values
+}
+
+type statusSink struct {
+	Name     string
+	Writes   float64
+	Failures float64
+}
+
+type statusPage struct {
+	Version       string
+	Uptime        time.Duration
+	Sources       map[string]bool
+	Sinks         []statusSink
+	EventsTotal   float64
+	EventsPerSec  float64
+	LastEventTime string
+	RecentErrors  []string
+}
+
+var statusTemplate = template.Must(template.New("status").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>faucet_agent</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; margin-bottom: 1em; }
+th, td { border: 1px solid #ccc; padding: 0.3em 0.8em; text-align: left; }
+.up { color: green; }
+.down { color: red; }
+</style>
+</head>
+<body>
+<h1>faucet_agent v{{.Version}}</h1>
+<p>Uptime: {{.Uptime}}</p>
+<h2>Event sources</h2>
+<table>
+<tr><th>Socket</th><th>State</th></tr>
+{{range $socket, $connected := .Sources}}<tr><td>{{$socket}}</td>{{if $connected}}<td class="up">connected</td>{{else}}<td class="down">disconnected</td>{{end}}</tr>
+{{else}}<tr><td colspan="2">No connection attempts yet</td></tr>
+{{end}}</table>
+<h2>Events</h2>
+<table>
+<tr><th>Received</th><td>{{printf "%.0f" .EventsTotal}}</td></tr>
+<tr><th>Events/sec</th><td>{{printf "%.2f" .EventsPerSec}}</td></tr>
+<tr><th>Last event</th><td>{{.LastEventTime}}</td></tr>
+</table>
+<h2>Sinks</h2>
+<table>
+<tr><th>Sink</th><th>Writes</th><th>Failures</th></tr>
+{{range .Sinks}}<tr><td>{{.Name}}</td><td>{{printf "%.0f" .Writes}}</td><td>{{printf "%.0f" .Failures}}</td></tr>
+{{end}}</table>
+<h2>Recent errors</h2>
+<ul>
+{{range .RecentErrors}}<li><code>{{.}}</code></li>
+{{else}}<li>None</li>
+{{end}}</ul>
+<p><a href="/metrics">Metrics</a></p>
+</body>
+</html>
+`))
+
+// Render a status summary built from the agent metrics
+func handleStatus(w http.ResponseWriter, r *http.Request) {
+	metrics := gatherSelfMetrics()
+
+	page := statusPage{
+		Version:       version.Version,
+		Uptime:        time.Since(startTime).Truncate(time.Second),
+		Sources:       map[string]bool{},
+		EventsPerSec:  math.Float64frombits(eventRate.Load()),
+		LastEventTime: "never",
+		RecentErrors:  recentErrors.list(),
+	}
+
+	for socket, connected := range selfMetricByLabel(metrics, "faucet_agent_socket_connected", "socket") {
+		page.Sources[socket] = connected == 1
+	}
+
+	failures := selfMetricByLabel(metrics, "faucet_agent_sink_write_failures_total", "sink")
+	for sink, writes := range selfMetricByLabel(metrics, "faucet_agent_sink_writes_total", "sink") {
+		page.Sinks = append(page.Sinks, statusSink{
+			Name:     sink,
+			Writes:   writes,
+			Failures: failures[sink],
+		})
+	}
+
+	slices.SortFunc(page.Sinks, func(a, b statusSink) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+
+	for _, events := range selfMetricByLabel(metrics, "faucet_agent_events_received_total", "type") {
+		page.EventsTotal += events
+	}
+
+	if last := lastEventTime.Load(); last != 0 {
+		page.LastEventTime = time.Unix(0, last).Format(statusTimestampFmt)
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+
+	if err := statusTemplate.Execute(w, page); err != nil {
+		slog.Warn("Failed to render status page", "error", err.Error())
+	}
+}
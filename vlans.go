@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+
+	dto "github.com/prometheus/client_model/go"
+	"go.yaml.in/yaml/v3"
+	"google.golang.org/protobuf/proto"
+)
+
+// VLAN names keyed by VID
+var vlanNames map[int]string
+
+// Highest VID that can be used on a VLAN
+const maxVID = 4095
+
+// Load a YAML file mapping VIDs or inclusive ranges of VIDs to VLAN names,
+// e.g:
+//
+//	100: office
+//	200: guest
+//	300-399: lab
+//
+// A single VID takes precedence over a range that includes it, while ranges
+// that overlap each other are an error.
+func loadVLANNames(path string) (map[int]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := map[string]string{}
+	if err := yaml.Unmarshal(data, &entries); err != nil {
+		return nil, err
+	}
+
+	names := map[int]string{}
+	single := map[int]string{}
+	ranges := map[int]string{}
+
+	// Sorted, so that the same file always gives the same error
+	for _, key := range slices.Sorted(maps.Keys(entries)) {
+		first, last, err := parseVIDRange(key)
+		if err != nil {
+			return nil, err
+		}
+
+		if first == last {
+			if other, ok := single[first]; ok {
+				return nil, fmt.Errorf("VID %d is named by both %q and %q", first, other, key)
+			}
+
+			single[first] = key
+			names[first] = entries[key]
+
+			continue
+		}
+
+		for vid := first; vid <= last; vid++ {
+			if other, ok := ranges[vid]; ok {
+				return nil, fmt.Errorf("VID range %q overlaps VID range %q", key, other)
+			}
+
+			ranges[vid] = key
+
+			if _, ok := single[vid]; !ok {
+				names[vid] = entries[key]
+			}
+		}
+	}
+
+	return names, nil
+}
+
+// Parse a VID, or an inclusive range of VIDs such as 100-199
+func parseVIDRange(key string) (int, int, error) {
+	firstText, lastText, isRange := strings.Cut(key, "-")
+	if !isRange {
+		lastText = firstText
+	}
+
+	first, err := strconv.Atoi(strings.TrimSpace(firstText))
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid VID %q", key)
+	}
+
+	last, err := strconv.Atoi(strings.TrimSpace(lastText))
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid VID %q", key)
+	}
+
+	if first < 0 || last > maxVID || first > last {
+		return 0, 0, fmt.Errorf("invalid VID range %q", key)
+	}
+
+	return first, last, nil
+}
+
+// Build a vid label, plus a vlan_name label if the VLAN has a name
+func vidLabels(vid int) []*dto.LabelPair {
+	labels := []*dto.LabelPair{
+		{
+			Name:  proto.String("vid"),
+			Value: proto.String(strconv.Itoa(vid)),
+		},
+	}
+
+	if name, ok := vlanNames[vid]; ok {
+		labels = append(labels, &dto.LabelPair{
+			Name:  proto.String("vlan_name"),
+			Value: proto.String(name),
+		})
+	}
+
+	return labels
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"maps"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadVLANNames(t *testing.T) {
+	tests := []struct {
+		name    string
+		yaml    string
+		want    map[int]string
+		wantErr bool
+	}{
+		{
+			name: "single VIDs",
+			yaml: "100: office\n200: guest\n",
+			want: map[int]string{100: "office", 200: "guest"},
+		},
+		{
+			name: "single VID inside a range",
+			yaml: "10-12: lab\n11: bench\n",
+			want: map[int]string{10: "lab", 11: "bench", 12: "lab"},
+		},
+		{
+			name:    "overlapping ranges",
+			yaml:    "10-20: lab\n15-25: test\n",
+			wantErr: true,
+		},
+		{
+			name:    "range inside a range",
+			yaml:    "10-20: lab\n12-13: test\n",
+			wantErr: true,
+		},
+		{
+			name:    "VID named twice",
+			yaml:    "100: office\n100-100: guest\n",
+			wantErr: true,
+		},
+		{
+			name:    "VID out of range",
+			yaml:    "4000-4096: lab\n",
+			wantErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "vlans.yaml")
+			if err := os.WriteFile(path, []byte(test.yaml), 0o644); err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := loadVLANNames(path)
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("got VLAN names %v, want an error", got)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !maps.Equal(got, test.want) {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
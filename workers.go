@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"sync"
+)
+
+// Handles events on a pool of goroutines, so that slow sinks don't hold up
+// reading from the event socket
+type eventWorkers struct {
+	events chan string
+	wg     sync.WaitGroup
+}
+
+func startEventWorkers(ctx context.Context, sinks []MetricSink, count int, buffer int) *eventWorkers {
+	w := &eventWorkers{
+		events: make(chan string, buffer),
+	}
+
+	for range count {
+		w.wg.Go(func() {
+			for event := range w.events {
+				handleEvent(ctx, sinks, event)
+			}
+		})
+	}
+
+	return w
+}
+
+// Queue an event for handling, dropping it if the buffer is full
+func (w *eventWorkers) offer(event string) {
+	select {
+	case w.events <- event:
+	default:
+		eventsDropped.WithLabelValues(dropBufferFull).Inc()
+	}
+}
+
+// Queue an event for handling, waiting for room in the buffer
+func (w *eventWorkers) submit(ctx context.Context, event string) {
+	select {
+	case w.events <- event:
+	case <-ctx.Done():
+	}
+}
+
+// Wait for queued events to be handled, no more events may be queued after
+func (w *eventWorkers) stop() {
+	close(w.events)
+	w.wg.Wait()
+}
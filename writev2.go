@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/url"
+
+	"github.com/golang/snappy"
+	"github.com/prometheus/prometheus/prompb"
+	writev2 "github.com/prometheus/prometheus/prompb/io/prometheus/write/v2"
+)
+
+// Remote write protocol versions
+const (
+	remoteWriteV1   = "1.0"
+	remoteWriteV2   = "2.0"
+	remoteWriteAuto = "auto"
+)
+
+// Convert a remote write 1.0 request to a 2.0 request, where label names and
+// values are interned in a symbols table
+func toWriteV2Request(writeRequest *prompb.WriteRequest) *writev2.Request {
+	metadata := make(map[string]prompb.MetricMetadata, len(writeRequest.Metadata))
+	for _, m := range writeRequest.Metadata {
+		metadata[m.MetricFamilyName] = m
+	}
+
+	symbols := writev2.NewSymbolTable()
+
+	request := &writev2.Request{
+		Timeseries: make([]writev2.TimeSeries, 0, len(writeRequest.Timeseries)),
+	}
+
+	for _, ts := range writeRequest.Timeseries {
+		series := writev2.TimeSeries{
+			LabelsRefs: symbolizeLabels(&symbols, ts.Labels),
+		}
+
+		for _, sample := range ts.Samples {
+			series.Samples = append(series.Samples, writev2.Sample{
+				Value:     sample.Value,
+				Timestamp: sample.Timestamp,
+			})
+		}
+
+		for _, exemplar := range ts.Exemplars {
+			series.Exemplars = append(series.Exemplars, writev2.Exemplar{
+				LabelsRefs: symbolizeLabels(&symbols, exemplar.Labels),
+				Value:      exemplar.Value,
+				Timestamp:  exemplar.Timestamp,
+			})
+		}
+
+		for _, label := range ts.Labels {
+			if label.Name != "__name__" {
+				continue
+			}
+
+			if m, ok := metadata[label.Value]; ok {
+				// Metric type values are the same in both versions
+				series.Metadata = writev2.Metadata{
+					Type:    writev2.Metadata_MetricType(m.Type),
+					HelpRef: symbols.Symbolize(m.Help),
+				}
+			}
+		}
+
+		request.Timeseries = append(request.Timeseries, series)
+	}
+
+	request.Symbols = symbols.Symbols()
+
+	return request
+}
+
+func symbolizeLabels(symbols *writev2.SymbolsTable, labels []prompb.Label) []uint32 {
+	refs := make([]uint32, 0, len(labels)*2)
+	for _, label := range labels {
+		refs = append(refs, symbols.Symbolize(label.Name), symbols.Symbolize(label.Value))
+	}
+
+	return refs
+}
+
+// Work out the remote write version a receiver supports by sending it an
+// empty 2.0 request. Only 2.0 receivers confirm how much they wrote, so
+// anything else falls back to 1.0.
+func detectRemoteWriteVersion(ctx context.Context, u *url.URL, opts *remoteWriteFlags) string {
+	client, err := newRemoteWriteClient(u, opts, remoteWriteV2)
+	if err != nil {
+		slog.Warn("Failed to create client to detect remote write version", "url", u.Redacted(), "error", err.Error())
+
+		return remoteWriteV1
+	}
+
+	request, err := (&writev2.Request{Symbols: []string{""}}).Marshal()
+	if err != nil {
+		return remoteWriteV1
+	}
+
+	if *promCompression == "snappy" {
+		request = snappy.Encode(nil, request)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, *promTimeout)
+	defer cancel()
+
+	stats, err := client.Store(ctx, request, 0)
+	if err != nil {
+		slog.Info(
+			"Receiver rejected remote write 2.0, using 1.0",
+			"url",
+			u.Redacted(),
+			"error",
+			err.Error(),
+		)
+
+		return remoteWriteV1
+	}
+
+	if !stats.Confirmed {
+		slog.Info("Receiver didn't confirm remote write 2.0 support, using 1.0", "url", u.Redacted())
+
+		return remoteWriteV1
+	}
+
+	slog.Info("Receiver supports remote write 2.0", "url", u.Redacted())
+
+	return remoteWriteV2
+}